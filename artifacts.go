@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Directory artifacts are copied to, in a directory per run
+const artifactsDir = "artifacts"
+
+const (
+	artifactsOnFailure = "failure"
+	artifactsAlways    = "always"
+)
+
+// ArtifactsConfig copies files like screenshots and logs out of the run
+// containers
+type ArtifactsConfig struct {
+	// Globs relative to the app, ** matches any number of directories
+	Paths []string `json:"paths"`
+
+	// Copy them from failed runs only, or always
+	When string `json:"when"`
+
+	// Larger files are skipped, as is everything once a run's artifacts
+	// add up to max_size
+	MaxFileSize string `json:"max_file_size"`
+	MaxSize     string `json:"max_size"`
+
+	maxFileSize int64
+	maxSize     int64
+}
+
+func (a *ArtifactsConfig) validate() error {
+	if len(a.Paths) == 0 {
+		return fmt.Errorf("artifacts without paths")
+	}
+
+	for _, p := range a.Paths {
+		if path.IsAbs(p) || strings.HasPrefix(path.Clean(p), "..") {
+			return fmt.Errorf("artifact path %s must be inside the app", p)
+		}
+
+		if _, err := globRegexp(path.Clean(p)); err != nil {
+			return fmt.Errorf("invalid artifact path %s: %v", p, err)
+		}
+
+		// Everything under the directory a glob starts in is streamed out of
+		// the container, which must not be the whole app
+		if prefix := globPrefix(path.Clean(p)); prefix == "" || prefix == "." {
+			return fmt.Errorf("artifact path %s must start with a directory, like tmp/screenshots/*.png", p)
+		}
+	}
+
+	switch a.When {
+	case "":
+		a.When = artifactsOnFailure
+	case artifactsOnFailure, artifactsAlways:
+	default:
+		return fmt.Errorf("artifacts when must be %s or %s", artifactsOnFailure, artifactsAlways)
+	}
+
+	if a.MaxFileSize == "" {
+		a.MaxFileSize = "50m"
+	}
+	if a.MaxSize == "" {
+		a.MaxSize = "200m"
+	}
+
+	var err error
+	if a.maxFileSize, err = parseMemory(a.MaxFileSize); err != nil {
+		return err
+	}
+	if a.maxSize, err = parseMemory(a.MaxSize); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Directory the artifacts of run are copied to
+func (b *Build) artifactDir(run string) string {
+	return filepath.Join(artifactsDir, run)
+}
+
+// Whether artifacts are copied from a run that failed or not
+func (b *Build) wantsArtifacts(failed bool) bool {
+	a := b.config.Artifacts
+	return a != nil && (failed || a.When == artifactsAlways)
+}
+
+// Copy the files matching the artifact globs out of the container of run,
+// returning their paths
+func (b *Build) collectArtifacts(h *DockerHost, container, run string) []string {
+	a := b.config.Artifacts
+	dest := b.artifactDir(run)
+
+	// A retried run replaces the artifacts of its first attempt
+	os.RemoveAll(dest)
+
+	c := &artifactCopy{
+		config: a,
+		dest:   dest,
+		copied: make(map[string]bool),
+	}
+
+	for _, p := range a.Paths {
+		p = path.Clean(p)
+		re, _ := globRegexp(p)
+
+		// docker cp doesn't do globs, so everything under the part of the
+		// glob without any is streamed and filtered here
+		prefix := globPrefix(p)
+
+		if err := c.copy(h, container, prefix, func(name string) bool { return re.MatchString(name) }); err != nil {
+			msg(fmt.Sprintf("Copying artifacts %s of run %v failed: %v", p, run, err))
+		}
+	}
+
+	if c.skipped > 0 {
+		msg(fmt.Sprintf("Skipped %d artifact(s) of run %v over the size limits", c.skipped, run))
+	}
+
+	return c.paths
+}
+
+// Leading directories of a glob without any wildcards
+func globPrefix(glob string) string {
+	parts := strings.Split(glob, "/")
+
+	for i, part := range parts {
+		if strings.ContainsAny(part, "*?[\\") {
+			return strings.Join(parts[:i], "/")
+		}
+	}
+
+	return glob
+}
+
+type artifactCopy struct {
+	config  *ArtifactsConfig
+	dest    string
+	copied  map[string]bool
+	paths   []string
+	size    int64
+	skipped int
+}
+
+// Copy the files under prefix in the app that match out of container
+func (c *artifactCopy) copy(h *DockerHost, container, prefix string, match func(name string) bool) error {
+	src := path.Join("/app", prefix)
+	cmd := exec.Command("docker", h.args("cp", container+":"+src, "-")...)
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	abort := func(err error) error {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	tr := tar.NewReader(out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return abort(err)
+		}
+
+		// Entries are named from the last element of src on
+		name := strings.TrimPrefix(path.Join(prefix, strings.TrimPrefix(hdr.Name, path.Base(src))), "/")
+		if hdr.Typeflag != tar.TypeReg || c.copied[name] || !match(name) {
+			continue
+		}
+
+		if hdr.Size > c.config.maxFileSize || c.size+hdr.Size > c.config.maxSize {
+			c.skipped++
+			continue
+		}
+
+		dest := filepath.Join(c.dest, filepath.FromSlash(name))
+		if err := writeArtifact(tr, dest); err != nil {
+			return abort(err)
+		}
+
+		c.copied[name] = true
+		c.paths = append(c.paths, dest)
+		c.size += hdr.Size
+	}
+
+	// A glob matching nothing in the container is fine
+	cmd.Wait()
+	return nil
+}
+
+func writeArtifact(r io.Reader, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/krisrang/cirunner/rspec"
+)
+
+var bisectCommand = cli.Command{
+	Name:  "bisect",
+	Usage: "find the feature that makes a scenario fail when run before it",
+	Description: "Takes the features a run ran as arguments in the order it ran them, or --run\n" +
+		"   to split the build again and use all other features of the run, as cucumber\n" +
+		"   may have run any of them first. --run needs the same --seed, --tags,\n" +
+		"   --splits and --maxruns as the build, the number of runs defaults to what\n" +
+		"   the docker hosts fit. The scenario that failed is given by --failing, like\n" +
+		"   features/checkout.feature:12.\n\n" +
+		"   Features are run in the given order, in fresh containers with a fresh\n" +
+		"   database every time, halving the features run before the failing scenario\n" +
+		"   until the one causing the failure is found.",
+	Action: bisect,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "failing",
+			Value: "",
+			Usage: "scenario or feature that failed, like features/checkout.feature:12",
+		},
+		cli.StringFlag{
+			Name:  "run",
+			Value: "",
+			Usage: "run of the build to take the features from, split with the same --seed, --tags, --splits and --maxruns",
+		},
+	},
+}
+
+func bisect(c *cli.Context) {
+	verbose = c.GlobalBool("verbose")
+	veryverbose = c.GlobalBool("veryverbose")
+	output = NewOutputMux(os.Stdout, c.GlobalBool("color"), c.GlobalBool("timestamps"))
+
+	failing := c.String("failing")
+	if failing == "" {
+		log.Fatal("Must specify the failing scenario")
+	}
+
+	if c.String("run") == "" && len(c.Args()) == 0 {
+		log.Fatal("Must specify the features of the run or --run")
+	}
+
+	b, err := newBuild(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	topic(fmt.Sprintf("Bisecting %s of %s", failing, b.name))
+
+	if err := b.prepare(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Every step runs after the one before it, so one host is enough
+	h := b.hosts[0]
+	b.hosts = b.hosts[:1]
+
+	before, err := featuresBefore([]string(c.Args()), failing)
+	if run := c.String("run"); run != "" {
+		before, err = b.runFeaturesBefore(run, failing)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(before) == 0 {
+		log.Fatal(fmt.Errorf("No features run before %s", failing))
+	}
+
+	msg(fmt.Sprintf("%d feature(s) may have run before %s, using seed %d", len(before), failing, b.seed))
+
+	if err := b.ensureImage(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := b.createCaches(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(b, cancel)
+
+	topic("Starting database")
+	if err := b.startDB(); err != nil {
+		log.Println(err)
+		os.Exit(b.cleanup(exitInfra))
+	}
+
+	if err := b.runPrepare(ctx); err != nil {
+		log.Println(err)
+		os.Exit(b.cleanup(setupFailed(ctx)))
+	}
+
+	bs := &bisection{ctx: ctx, build: b, host: h, failing: failing}
+	polluter, err := bs.find(before)
+	if err != nil {
+		log.Println(err)
+		os.Exit(b.cleanup(setupFailed(ctx)))
+	}
+
+	topic("Bisect result")
+	switch {
+	case bs.isolated:
+		msg(fmt.Sprintf("%s fails on its own, it doesn't depend on the features before it", failing))
+		os.Exit(b.cleanup(exitFailed))
+	case len(polluter) == 0:
+		msg(fmt.Sprintf("%s passes after all %d feature(s) run before it in this order", failing, len(before)))
+		os.Exit(b.cleanup(exitFailed))
+	case len(polluter) > 1:
+		msg(fmt.Sprintf("%s fails only after these features together:", failing))
+		for _, f := range polluter {
+			msg("  " + f)
+		}
+	default:
+		msg(fmt.Sprintf("%s fails when run after %s", failing, polluter[0]))
+	}
+
+	msg(fmt.Sprintf("Reproduce with: %s", strings.Join(b.cucumberCmd("defined", append(polluter, failing)), " ")))
+	os.Exit(b.cleanup(exitPassed))
+}
+
+// Features of run but the one of failing when the build is split with the
+// current flags and seed. Cucumber ran them in random order, so any of them
+// may have run before failing.
+func (b *Build) runFeaturesBefore(run, failing string) ([]string, error) {
+	features, err := b.selectFeatures()
+	if err != nil {
+		return nil, err
+	}
+
+	file := featureFile(failing)
+
+	for _, s := range b.splits(features, []rspec.SpecFile{}) {
+		if s.run != run {
+			continue
+		}
+
+		paths := make([]string, 0, len(s.features))
+		found := false
+		for _, f := range s.features {
+			if f.Path == file {
+				found = true
+				continue
+			}
+			paths = append(paths, f.Path)
+		}
+
+		if !found {
+			return nil, fmt.Errorf("%s isn't in run %s, is the build split with the same --seed, --tags, --splits and --maxruns?", file, run)
+		}
+
+		return paths, nil
+	}
+
+	return nil, fmt.Errorf("No run %s in the build", run)
+}
+
+// Features run before failing
+func featuresBefore(features []string, failing string) ([]string, error) {
+	file := featureFile(failing)
+
+	for i, f := range features {
+		if f == file {
+			return features[:i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s isn't among the features given", file)
+}
+
+// Feature file of a scenario, which may be given by line after a colon
+func featureFile(scenario string) string {
+	if i := strings.LastIndex(scenario, ":"); i >= 0 {
+		return scenario[:i]
+	}
+
+	return scenario
+}
+
+type bisection struct {
+	ctx      context.Context
+	build    *Build
+	host     *DockerHost
+	failing  string
+	step     int
+	isolated bool
+}
+
+// Narrow down the features before the failing scenario to those it fails
+// after, returning none when it doesn't fail after any of them
+func (bs *bisection) find(before []string) ([]string, error) {
+	failed, err := bs.try(nil)
+	if err != nil || failed {
+		bs.isolated = failed
+		return nil, err
+	}
+
+	if failed, err = bs.try(before); err != nil || !failed {
+		return nil, err
+	}
+
+	candidates := before
+	for len(candidates) > 1 {
+		half := len(candidates) / 2
+
+		failed, err := bs.try(candidates[:half])
+		if err != nil {
+			return nil, err
+		}
+		if failed {
+			candidates = candidates[:half]
+			continue
+		}
+
+		if failed, err = bs.try(candidates[half:]); err != nil {
+			return nil, err
+		}
+		if !failed {
+			// Takes features of both halves
+			break
+		}
+		candidates = candidates[half:]
+	}
+
+	return candidates, nil
+}
+
+// Run features and then the failing scenario in a run of their own,
+// reporting whether the scenario failed
+func (bs *bisection) try(features []string) (bool, error) {
+	b := bs.build
+	bs.step++
+
+	s := Split{
+		run:        fmt.Sprintf("bisect-%d", bs.step),
+		reportSrc:  "features/reports",
+		reportDest: fmt.Sprintf("features/reports/bisect-%d", bs.step),
+		triage:     true,
+	}
+
+	s.cmd = b.cucumberCmd("defined", append(append([]string{}, features...), bs.failing))
+
+	if len(features) == 0 {
+		topic(fmt.Sprintf("Step %d: running %s alone", bs.step, bs.failing))
+	} else {
+		topic(fmt.Sprintf("Step %d: running %s after %d feature(s)", bs.step, bs.failing, len(features)))
+	}
+
+	r := runSplit(bs.ctx, b, bs.host, s)
+	switch r.status {
+	case statusPassed:
+		msg("Passed")
+		return false, nil
+	case statusFailed:
+	default:
+		return false, fmt.Errorf("Step %d %s: %s\n%s\n%s", bs.step, r.status, r.comment, r.stdout.String(), r.stderr.String())
+	}
+
+	failed, err := s.failedScenarios()
+	if err != nil {
+		return false, fmt.Errorf("Reading failed scenarios of step %d failed: %v", bs.step, err)
+	}
+
+	if !rerunIncludes(failed, bs.failing) {
+		msg(fmt.Sprintf("Passed, other scenarios failed: %s", strings.Join(failed, " ")))
+		return false, nil
+	}
+
+	msg("Failed")
+	return true, nil
+}
@@ -0,0 +1,772 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/pebblescape/pebblescape/pkg/random"
+	"github.com/krisrang/cirunner/cucumber"
+	"github.com/krisrang/cirunner/rspec"
+)
+
+// Build holds the settings of a single cirunner build
+type Build struct {
+	path  string
+	name  string
+	id    string
+	image string
+	// Image built or pulled, before the prepare step
+	baseImage string
+	tagArgs   []string
+	slowTags  []string
+	// Git ref to select tests affected by changes since
+	changedSince string
+	impact       *Impact
+	dataDir      string
+	runs         int
+	splitRuns    int
+	cpus         float64
+	memory       int64
+	hosts        []*DockerHost
+	config       *Config
+	docker       ImageOptions
+	started      time.Time
+	grace        time.Duration
+	timeout      time.Duration
+	seed         int
+	nodeIndex    int
+	nodeTotal    int
+}
+
+func newBuild(c *cli.Context) (*Build, error) {
+	return newBuildWithID(c, c.GlobalString("name"), c.GlobalString("id"))
+}
+
+func newBuildWithID(c *cli.Context, name, id string) (*Build, error) {
+	path, err := filepath.Abs(c.GlobalString("path"))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Build{
+		path:         path,
+		name:         strings.ToLower(name),
+		id:           id,
+		tagArgs:      c.GlobalStringSlice("tags"),
+		slowTags:     c.GlobalStringSlice("slowtags"),
+		changedSince: c.GlobalString("changed-since"),
+		runs:         c.GlobalInt("maxruns"),
+		splitRuns:    c.GlobalInt("splits"),
+		started:      time.Now(),
+		grace:        c.GlobalDuration("grace"),
+		timeout:      c.GlobalDuration("timeout"),
+		seed:         c.GlobalInt("seed"),
+		docker: ImageOptions{
+			prebuilt:   c.GlobalString("image") != "",
+			registry:   strings.TrimSuffix(c.GlobalString("registry"), "/"),
+			dockerfile: c.GlobalString("dockerfile"),
+			target:     c.GlobalString("target"),
+			buildArgs:  resolveBuildArgs(c.GlobalStringSlice("build-arg")),
+			tags:       c.GlobalStringSlice("image-tag"),
+			pull:       c.GlobalBool("pull"),
+			noCache:    c.GlobalBool("no-cache"),
+		},
+		nodeIndex: c.GlobalInt("node-index"),
+		nodeTotal: c.GlobalInt("node-total"),
+	}
+
+	if b.name == "" {
+		return nil, fmt.Errorf("Must specify build name")
+	}
+
+	if b.id == "" {
+		b.id = random.Hex(4)
+	}
+
+	// Seeds are kept in the range rspec picks them from
+	if b.seed == 0 {
+		b.seed = rand.New(rand.NewSource(time.Now().UnixNano())).Intn(0xffff) + 1
+	}
+
+	if s := c.GlobalString("cpus"); s != "" {
+		if b.cpus, err = strconv.ParseFloat(s, 64); err != nil || b.cpus <= 0 {
+			return nil, fmt.Errorf("Invalid number of CPUs %s", s)
+		}
+	}
+
+	if s := c.GlobalString("memory"); s != "" {
+		if b.memory, err = parseMemory(s); err != nil {
+			return nil, err
+		}
+	}
+
+	maxruns := b.runs
+	if b.runs == 0 {
+		b.runs = defaultRuns(b.cpus, b.memory)
+	}
+
+	b.config, err = loadConfig(b.path, c.GlobalString("config"))
+	if err != nil {
+		return nil, err
+	}
+
+	b.dataDir = c.GlobalString("data-dir")
+	if b.dataDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		b.dataDir = filepath.Join(home, ".cirunner")
+	}
+
+	// maxruns limits feature runs, on the default host the rspec run has
+	// always run alongside them. Other hosts without a capacity of their own
+	// are sized to their resources unless maxruns is given.
+	b.hosts, err = parseHosts(c, maxruns, b.runs+1)
+	if err != nil {
+		return nil, err
+	}
+
+	capacity := 0
+	for _, h := range b.hosts {
+		if h.capacity == 0 {
+			if h.capacity, err = h.defaultRuns(b.cpus, b.memory); err != nil {
+				return nil, err
+			}
+		}
+		capacity += h.capacity
+	}
+
+	if b.splitRuns == 0 {
+		b.splitRuns = b.runs
+		if len(b.hosts) > 1 || b.hosts[0].url != "" {
+			b.splitRuns = capacity
+		}
+	}
+
+	if err := b.validateShard(); err != nil {
+		return nil, err
+	}
+
+	b.image = b.name
+	if b.docker.prebuilt {
+		b.image = c.GlobalString("image")
+	}
+
+	for i, h := range b.hosts {
+		h.dbcnt = fmt.Sprintf("%s-%s-db", b.name, b.id)
+		if len(b.hosts) > 1 {
+			h.dbcnt = fmt.Sprintf("%s-%d", h.dbcnt, i+1)
+		}
+	}
+
+	return b, nil
+}
+
+func (b *Build) chdir() error {
+	return os.Chdir(b.path)
+}
+
+// Change to the build directory, put CI config files in place and remove
+// reports of earlier builds
+func (b *Build) prepare() error {
+	msg(fmt.Sprintf("Changing working directory to %s", b.path))
+	if err := b.chdir(); err != nil {
+		return err
+	}
+
+	topic("Preparing config files and cleaning old reports")
+	os.Rename("config/database.ci.yml", "config/database.yml")
+	os.Rename("config/redis.ci.yml", "config/redis.yml")
+	os.RemoveAll("spec/reports")
+	os.RemoveAll("features/reports")
+
+	if cov := b.config.Coverage; cov != nil {
+		os.RemoveAll(filepath.Join(cov.Path, "runs"))
+		os.Remove(filepath.Join(cov.Path, ".resultset.json"))
+		os.Remove(filepath.Join(cov.Path, "coverage.xml"))
+	}
+
+	if b.config.Artifacts != nil {
+		os.RemoveAll(artifactsDir)
+	}
+
+	os.RemoveAll(isolationDir)
+
+	return nil
+}
+
+// Make sure every host has the image of the build, building it unless a
+// pre-built one was given
+func (b *Build) ensureImage() error {
+	var err error
+	if b.docker.prebuilt {
+		topic(fmt.Sprintf("Using pre-built image %s", b.image))
+		err = b.pullImage()
+	} else {
+		topic("Building base image")
+		err = b.buildImage()
+	}
+
+	b.baseImage = b.image
+	return err
+}
+
+// Make sure the pre-built image exists on every host, pulling it where
+// it's missing
+func (b *Build) pullImage() error {
+	return eachHost(b.hosts, func(h *DockerHost) error {
+		if err, _, _ := h.docker(veryverbose, "image", "inspect", b.image); err == nil {
+			msg(fmt.Sprintf("Found image %s on %v", b.image, h))
+			return nil
+		}
+
+		ref := b.docker.remote(b.image)
+		msg(fmt.Sprintf("Pulling image %s on %v", ref, h))
+		if err, _, stderr := h.docker(veryverbose, "pull", ref); err != nil {
+			return fmt.Errorf("Pulling image %s failed: %v\n%s", ref, err, stderr.String())
+		}
+
+		if ref != b.image {
+			if err, _, stderr := h.docker(veryverbose, "tag", ref, b.image); err != nil {
+				return fmt.Errorf("Tagging image %s failed: %v\n%s", ref, err, stderr.String())
+			}
+		}
+
+		return nil
+	})
+}
+
+// Build the image on every host, tagged with the hash of the build context
+// and options. Hosts that already have an image of the same context reuse
+// it, unless a fresh build is asked for.
+func (b *Build) buildImage() error {
+	tagged, err := b.contextImage()
+	if err != nil {
+		return err
+	}
+
+	tags := append([]string{b.name, tagged}, b.docker.tags...)
+
+	err = eachHost(b.hosts, func(h *DockerHost) error {
+		if err, _, _ := h.docker(veryverbose, "image", "inspect", tagged); err == nil && !b.docker.fresh() {
+			msg(fmt.Sprintf("Reusing image %s on %v", tagged, h))
+			for _, tag := range tags {
+				if tag != tagged {
+					h.docker(veryverbose, "tag", tagged, tag)
+				}
+			}
+			return nil
+		}
+
+		if err, _, stderr := h.docker(veryverbose, b.docker.args(tags, b.imageLabels())...); err != nil {
+			return fmt.Errorf("Building image failed: %v\n%s", err, stderr.String())
+		}
+
+		msg(fmt.Sprintf("Rebuilt image %s on %v", tagged, h))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b.image = tagged
+	return nil
+}
+
+// Tag of the image built from the current build context, which changes
+// with the context and the options of the build
+func (b *Build) contextImage() (string, error) {
+	hash, err := contextHash(".", b.docker.dockerfile)
+	if err != nil {
+		return "", fmt.Errorf("Hashing build context failed: %v", err)
+	}
+
+	return fmt.Sprintf("%s:ctx-%s", b.name, b.docker.hash(hash)[:12]), nil
+}
+
+// Image runs use, once the image is built and the prepare step has run
+func (b *Build) runImage() (string, error) {
+	if p := b.config.Prepare; p != nil && p.Path == "" {
+		return b.container("prepared"), nil
+	}
+
+	if b.docker.prebuilt {
+		return b.image, nil
+	}
+
+	return b.contextImage()
+}
+
+// Name of the container of run
+func (b *Build) container(run string) string {
+	return fmt.Sprintf("%s-%s-%s", b.name, b.id, run)
+}
+
+// Name of the redis container of run
+func (b *Build) redisContainer(run string) string {
+	return b.container(run) + "-redis"
+}
+
+// Name of the container migrating the database of run
+func (b *Build) migrateContainer(run string) string {
+	return b.container(run) + "-migrate"
+}
+
+// Name of the test database of run
+func (b *Build) dbName(run string) string {
+	return strings.Replace(fmt.Sprintf("%s_%s_%s_test", b.name, b.id, run), "-", "_", -1)
+}
+
+// Environment, links and cache volumes of the containers of run on host h
+func (b *Build) envArgs(h *DockerHost, run string) []string {
+	args := []string{
+		"-e", "RAILS_ENV=test",
+		"-e", "DBNAME=" + b.dbName(run),
+		"--link", h.dbcnt + ":db",
+		"--link", b.redisContainer(run) + ":redis",
+	}
+
+	return append(args, b.volumeArgs()...)
+}
+
+// Cache and prepared volumes mounted into containers
+func (b *Build) volumeArgs() []string {
+	args := make([]string, 0)
+
+	for _, cache := range b.config.Caches {
+		args = append(args, "-v", b.cacheVolume(cache)+":"+cache.Path)
+	}
+
+	if p := b.config.Prepare; p != nil && p.Path != "" {
+		args = append(args, "-v", b.container("prepared")+":"+p.Path)
+	}
+
+	return args
+}
+
+// Name of the volume of cache, shared by all builds of the same name
+func (b *Build) cacheVolume(cache CacheVolume) string {
+	return fmt.Sprintf("%s-cache-%s", b.name, cache.Name)
+}
+
+// Create the cache volumes on every host, they aren't tracked as resources
+// of the build so they outlive it
+func (b *Build) createCaches() error {
+	if len(b.config.Caches) == 0 {
+		return nil
+	}
+
+	topic("Creating cache volumes")
+	return eachHost(b.hosts, func(h *DockerHost) error {
+		for _, cache := range b.config.Caches {
+			volume := b.cacheVolume(cache)
+
+			if err, _, _ := h.docker(veryverbose, "volume", "inspect", volume); err == nil {
+				continue
+			}
+
+			msg(fmt.Sprintf("Creating cache %s on %v", volume, h))
+			if err, _, stderr := h.docker(veryverbose, "volume", "create", "--label", labelCache+"="+b.name, volume); err != nil {
+				return fmt.Errorf("Creating cache %s failed: %v\n%s", volume, err, stderr.String())
+			}
+		}
+
+		return nil
+	})
+}
+
+// CPU and memory limits of the containers of a run
+func (b *Build) limitArgs() []string {
+	args := make([]string, 0)
+
+	if b.cpus > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(b.cpus, 'f', -1, 64))
+	}
+
+	if b.memory > 0 {
+		args = append(args, "--memory", strconv.FormatInt(b.memory, 10))
+	}
+
+	return args
+}
+
+// Whether container was killed for running out of memory
+func (b *Build) oomKilled(h *DockerHost, container string) bool {
+	err, stdout, _ := h.docker(veryverbose, "inspect", "--type", "container", "--format", "{{.State.OOMKilled}}", container)
+
+	return err == nil && strings.TrimSpace(stdout.String()) == "true"
+}
+
+// Arguments to docker for starting a container of run on host h, the
+// command to run inside it has to be appended
+func (b *Build) runArgs(h *DockerHost, run string) []string {
+	args := append([]string{"run", "--name", b.container(run)}, b.labels()...)
+	args = append(args, b.limitArgs()...)
+	args = append(args, b.envArgs(h, run)...)
+
+	return append(args, b.image)
+}
+
+// Arguments to docker for loading the schema and migrating the database of
+// run on host h
+func (b *Build) migrateArgs(h *DockerHost, run string) []string {
+	args := append([]string{"run", "--rm", "--name", b.migrateContainer(run)}, b.labels()...)
+	args = append(args, b.limitArgs()...)
+	args = append(args, b.envArgs(h, run)...)
+
+	return append(args, b.image, "bundle", "exec", "rake", "db:create", "db:schema:load", "db:migrate")
+}
+
+// Arguments to docker for starting the redis container of run
+func (b *Build) redisArgs(run string) []string {
+	args := append([]string{"run", "-d", "--name", b.redisContainer(run)}, b.labels()...)
+
+	return append(args, "redis")
+}
+
+// Run the prepare step once on every host, committing the container as the
+// image of the runs or leaving the result in the prepared volume
+func (b *Build) runPrepare(ctx context.Context) error {
+	p := b.config.Prepare
+	if p == nil {
+		return nil
+	}
+
+	topic(fmt.Sprintf("Preparing image with %s", strings.Join(p.Command, " ")))
+	prepared := b.container("prepared")
+
+	err := eachHost(b.hosts, func(h *DockerHost) error {
+		cnt := b.container("prepare")
+		h.docker(veryverbose, "rm", "-f", "-v", cnt)
+
+		if p.Path != "" {
+			h.resources.Track(kindVolume, prepared)
+			args := append([]string{"volume", "create"}, b.labels()...)
+			if err, _, stderr := h.docker(veryverbose, append(args, prepared)...); err != nil {
+				return fmt.Errorf("Creating prepared volume failed: %v\n%s", err, stderr.String())
+			}
+		}
+
+		h.resources.Track(kindContainer, cnt)
+		defer h.resources.Release(kindContainer, cnt)
+
+		args := append([]string{"run", "--name", cnt}, b.labels()...)
+		args = append(args, "-e", "RAILS_ENV=test", "--link", h.dbcnt+":db")
+		args = append(args, b.volumeArgs()...)
+		args = append(args, b.image)
+
+		stopWait := stopOnCancel(ctx, h, b.grace, cnt)
+		err, stdout, stderr := h.docker(verbose, append(args, p.Command...)...)
+		stopWait()
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("Prepare step aborted")
+		}
+		if err != nil {
+			return fmt.Errorf("Prepare step failed: %v\n%s\n%s", err, stdout.String(), stderr.String())
+		}
+
+		if p.Path != "" {
+			return nil
+		}
+
+		h.resources.Track(kindImage, prepared)
+		change := fmt.Sprintf("LABEL %s=%s %s=%s %s=%d", labelBuild, b.name, labelID, b.id, labelStarted, b.started.Unix())
+		if err, _, stderr := h.docker(veryverbose, "commit", "--change", change, cnt, prepared); err != nil {
+			return fmt.Errorf("Committing prepared image failed: %v\n%s", err, stderr.String())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.Path == "" {
+		b.image = prepared
+	}
+
+	return nil
+}
+
+// Start the database containers shared by all runs of each host and wait
+// for them to boot
+func (b *Build) startDB() error {
+	return eachHost(b.hosts, func(h *DockerHost) error {
+		h.docker(veryverbose, "rm", "-f", "-v", h.dbcnt)
+
+		h.resources.Track(kindContainer, h.dbcnt)
+		args := append([]string{"run", "-d", "--name", h.dbcnt}, b.labels()...)
+		args = append(args, "-e", "MYSQL_ROOT_PASSWORD=jenkins", "mariadb:latest")
+
+		if err, stdout, stderr := h.docker(veryverbose, args...); err != nil {
+			return fmt.Errorf("Starting DB failed: %v\n%s\n%s", err, stdout.String(), stderr.String())
+		}
+
+		// Wait for DB to boot
+		time.Sleep(10 * time.Second)
+
+		return nil
+	})
+}
+
+// Select features of this node
+func (b *Build) selectFeatures() ([]cucumber.FeatureFile, error) {
+	tags := cucumber.ParseTags(b.tagArgs, b.slowTags)
+	filters := make([]cucumber.Filter, 0)
+
+	if b.changedSince != "" {
+		impact, err := b.loadImpact()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, impact.featureFilter())
+	}
+
+	features, err := cucumber.Select(tags, filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.sharded() {
+		features = shardFeatures(features, b.nodeIndex, b.nodeTotal)
+	}
+
+	return features, nil
+}
+
+// Select specs of this node affected by changes. Returns nil when all specs
+// are selected and the build isn't sharded, the rspec run then runs the
+// whole suite.
+func (b *Build) selectSpecs() ([]rspec.SpecFile, error) {
+	filters := make([]rspec.Filter, 0)
+
+	if b.changedSince != "" {
+		impact, err := b.loadImpact()
+		if err != nil {
+			return nil, err
+		}
+
+		if !impact.allSpecs {
+			filters = append(filters, impact.specFilter())
+		}
+	}
+
+	if !b.sharded() && len(filters) == 0 {
+		return nil, nil
+	}
+
+	specs, err := rspec.Select(filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.sharded() {
+		specs = shardSpecs(specs, b.nodeIndex, b.nodeTotal)
+	}
+
+	return specs, nil
+}
+
+// Split features and set up the commands for all runs of the build, rspec
+// run first followed by feature runs in order
+func (b *Build) splits(features []cucumber.FeatureFile, specs []rspec.SpecFile) []Split {
+	splits := make([]Split, 0)
+
+	if specs == nil || len(specs) > 0 {
+		paths := make([]string, 0, len(specs))
+		for _, spec := range specs {
+			paths = append(paths, spec.Path)
+		}
+
+		splits = append(splits, Split{
+			run:        "rspec",
+			specs:      specs,
+			reportSrc:  "spec/reports",
+			reportDest: "spec",
+			cmd:        append(b.rspecCmd(), paths...),
+		})
+	}
+
+	// Features of suites run in runs of their own named after the suite
+	suiteSplits := make([]Split, 0)
+	for _, suite := range b.config.Suites {
+		var picked []cucumber.FeatureFile
+		picked, features = suiteFeatures(suite, features)
+
+		if len(picked) > 0 {
+			suiteSplits = append(suiteSplits, Split{
+				features: picked,
+				run:      suite.Name,
+				suite:    suite.Name,
+			})
+		}
+	}
+
+	featureSplits := splitFeatures(b.splitRuns, features)
+
+	// Shuffled in the same order every time, so the same seed gives the
+	// same splits
+	rnd := rand.New(rand.NewSource(int64(b.seed)))
+
+	ids := make([]int, 0)
+	for id := range featureSplits {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		splits = append(splits, b.featureSplit(rnd, featureSplits[id]))
+	}
+
+	for _, s := range suiteSplits {
+		splits = append(splits, b.featureSplit(rnd, s))
+	}
+
+	return splits
+}
+
+// Shuffle the features of s and set up its reports and command
+func (b *Build) featureSplit(rnd *rand.Rand, s Split) Split {
+	for i := range s.features {
+		j := rnd.Intn(i + 1)
+		s.features[i], s.features[j] = s.features[j], s.features[i]
+	}
+
+	s.reportSrc = "features/reports"
+	s.reportDest = "features/reports/" + s.run
+	s.cmd = b.featureCmd(s)
+
+	return s
+}
+
+// Split features into those tagged with any tag of suite and the rest
+func suiteFeatures(suite Suite, features []cucumber.FeatureFile) ([]cucumber.FeatureFile, []cucumber.FeatureFile) {
+	picked := make([]cucumber.FeatureFile, 0)
+	rest := make([]cucumber.FeatureFile, 0)
+
+	for _, f := range features {
+		tagged := false
+		for _, t := range f.Feature.Tags {
+			for _, tag := range suite.Tags {
+				if t.Name == "@"+strings.TrimPrefix(tag, "@") {
+					tagged = true
+				}
+			}
+		}
+
+		if tagged {
+			picked = append(picked, f)
+		} else {
+			rest = append(rest, f)
+		}
+	}
+
+	return picked, rest
+}
+
+// Whether failures of s fail the build
+func (b *Build) blocking(s Split) bool {
+	for _, suite := range b.config.Suites {
+		if suite.Name == s.suite {
+			return !suite.NonBlocking
+		}
+	}
+
+	return true
+}
+
+func (b *Build) featureCmd(s Split) []string {
+	paths := make([]string, 0, len(s.features))
+	for _, f := range s.features {
+		paths = append(paths, f.Path)
+	}
+
+	return b.cucumberCmd(fmt.Sprintf("random:%d", b.seed), paths)
+}
+
+// Rspec command without the specs to run
+func (b *Build) rspecCmd() []string {
+	return []string{
+		"bundle", "exec", "rspec",
+		"--format", "progress",
+		"--format", "RspecJunitFormatter",
+		"--out", "spec/reports/rspec.xml",
+		"--color", "--no-drb",
+		"--seed", strconv.Itoa(b.seed),
+	}
+}
+
+// Cucumber command running paths in order, which is "defined" or like
+// "random:<seed>". Failed scenarios are listed in the rerun file of the
+// reports.
+func (b *Build) cucumberCmd(order string, paths []string) []string {
+	cmd := []string{
+		"bundle", "exec", "cucumber",
+		"-r", "features",
+		"--format", "progress",
+		"--format", "junit",
+		"--out", "features/reports",
+		"--format", "rerun",
+		"--out", "features/reports/" + rerunFile,
+		"--color", "--no-drb",
+		"--order", order,
+	}
+
+	for _, t := range b.tagArgs {
+		cmd = append(cmd, "--tags", t)
+	}
+
+	return append(cmd, paths...)
+}
+
+func splitFeatures(runs int, feat []cucumber.FeatureFile) map[int]Split {
+	result := make(map[int]Split, 0)
+
+	for i, f := range feat {
+		id := (i + 1) % runs
+		if id == 0 {
+			id = runs
+		}
+
+		res, ok := result[id]
+		if !ok {
+			res = Split{
+				features: make([]cucumber.FeatureFile, 0),
+				run:      strconv.Itoa(id),
+			}
+		}
+
+		res.features = append(res.features, f)
+		result[id] = res
+	}
+
+	return result
+}
+
+// Directory the reports of s end up in once copied from the container
+func (s Split) reportDir() string {
+	return filepath.Join(s.reportDest, filepath.Base(s.reportSrc))
+}
+
+// Total step and example weight of the features and specs in split
+func (s Split) weight() int {
+	weight := 0
+	for _, f := range s.features {
+		weight += f.Weight
+	}
+	for _, spec := range s.specs {
+		weight += spec.Weight
+	}
+
+	return weight
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/codegangsta/cli"
+)
+
+// Labels put on every docker resource cirunner creates
+const (
+	labelBuild   = "cirunner.build"
+	labelID      = "cirunner.id"
+	labelStarted = "cirunner.started"
+	labelCache   = "cirunner.cache"
+	labelImage   = "cirunner.image"
+)
+
+// Images of build contexts kept per build name, older ones are removed by
+// the sweep and clean
+const keptImages = 5
+
+// Kinds of docker resources
+const (
+	kindContainer = "container"
+	kindNetwork   = "network"
+	kindVolume    = "volume"
+	kindImage     = "image"
+)
+
+type resourceKind struct {
+	name   string
+	list   []string
+	rm     []string
+	id     string
+	labels string
+}
+
+// Kinds of resources cleaned up, in order of removal
+var resourceKinds = []resourceKind{
+	{
+		name:   kindContainer,
+		list:   []string{"ps", "-a", "-q", "--no-trunc"},
+		rm:     []string{"rm", "-f", "-v"},
+		id:     ".Id",
+		labels: ".Config.Labels",
+	},
+	{
+		name:   kindNetwork,
+		list:   []string{"network", "ls", "-q", "--no-trunc"},
+		rm:     []string{"network", "rm"},
+		id:     ".Id",
+		labels: ".Labels",
+	},
+	{
+		name:   kindVolume,
+		list:   []string{"volume", "ls", "-q"},
+		rm:     []string{"volume", "rm", "-f"},
+		id:     ".Name",
+		labels: ".Labels",
+	},
+	{
+		name:   kindImage,
+		list:   []string{"images", "-q", "--no-trunc"},
+		rm:     []string{"rmi", "-f"},
+		id:     ".Id",
+		labels: ".Config.Labels",
+	},
+}
+
+var cleanCommand = cli.Command{
+	Name:  "clean",
+	Usage: "remove containers, networks, volumes and images left behind by builds",
+	Description: "Removes resources of the build given by --name and --id, limited to resources\n" +
+		"   older than --older-than. Resources of all builds are only removed with\n" +
+		"   --older-than, so running builds aren't touched. Cache volumes are kept across\n" +
+		"   builds and only removed with --caches. Of the images built for each build\n" +
+		"   context, the newest " + strconv.Itoa(keptImages) + " of every build name are kept.",
+	Action: clean,
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "older-than",
+			Value: 0,
+			Usage: "only remove resources of builds started before this long ago",
+		},
+		cli.BoolFlag{
+			Name:  "caches",
+			Usage: "also remove the cache volumes of --name, or of all builds",
+		},
+	},
+}
+
+func clean(c *cli.Context) {
+	verbose = c.GlobalBool("verbose")
+	veryverbose = c.GlobalBool("veryverbose")
+
+	name := strings.ToLower(c.GlobalString("name"))
+	id := c.GlobalString("id")
+	olderThan := c.Duration("older-than")
+
+	// Cache volumes alone may be removed for all builds, they're recreated
+	// by the next build
+	selected := name != "" || id != "" || olderThan > 0
+	if !selected && !c.Bool("caches") {
+		log.Fatal("Must specify --name, --id, --older-than or --caches, cleaning every build would include running ones")
+	}
+
+	hosts, err := parseHosts(c, 1, 1)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	topic("Cleaning up build resources")
+	err = eachHost(hosts, func(h *DockerHost) error {
+		if c.Bool("caches") {
+			if err := removeCaches(h, name); err != nil {
+				return err
+			}
+		}
+
+		if !selected {
+			return nil
+		}
+
+		if id == "" {
+			if err := removeOldImages(h, name, keptImages); err != nil {
+				return err
+			}
+		}
+
+		return removeResources(h, name, id, olderThan)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Remove cache volumes, optionally limited to those of a build name
+func removeCaches(host *DockerHost, name string) error {
+	filter := "label=" + labelCache
+	if name != "" {
+		filter += "=" + name
+	}
+
+	err, stdout, stderr := host.docker(veryverbose, "volume", "ls", "-q", "--filter", filter)
+	if err != nil {
+		return fmt.Errorf("Listing caches failed: %v\n%s", err, stderr.String())
+	}
+
+	volumes := uniqueFields(stdout.String())
+	if len(volumes) == 0 {
+		return nil
+	}
+
+	msg(fmt.Sprintf("Removing %d cache(s) on %v", len(volumes), host))
+	if err, _, stderr := host.docker(veryverbose, append([]string{"volume", "rm", "-f"}, volumes...)...); err != nil {
+		return fmt.Errorf("Removing caches failed: %v\n%s", err, stderr.String())
+	}
+
+	return nil
+}
+
+// Labels of a resource belonging to build, given as docker arguments
+func (b *Build) labels() []string {
+	return []string{
+		"--label", labelBuild + "=" + b.name,
+		"--label", labelID + "=" + b.id,
+		"--label", labelStarted + "=" + strconv.FormatInt(b.started.Unix(), 10),
+	}
+}
+
+// Labels of the images built for build contexts, which outlive builds and
+// are removed by removeOldImages
+func (b *Build) imageLabels() []string {
+	return []string{
+		"--label", labelImage + "=" + b.name,
+		"--label", labelStarted + "=" + strconv.FormatInt(b.started.Unix(), 10),
+	}
+}
+
+// Remove images of build contexts but the newest keep of every build name,
+// optionally only those of name
+func removeOldImages(host *DockerHost, name string, keep int) error {
+	filter := "label=" + labelImage
+	if name != "" {
+		filter += "=" + name
+	}
+
+	err, stdout, stderr := host.docker(veryverbose, "images", "--filter", filter, "--format", "{{.Repository}}:{{.Tag}}")
+	if err != nil {
+		return fmt.Errorf("Listing images failed: %v\n%s", err, stderr.String())
+	}
+
+	// Images are listed newest first
+	kept := make(map[string]int)
+	old := make([]string, 0)
+
+	for _, ref := range uniqueFields(stdout.String()) {
+		i := strings.LastIndex(ref, ":")
+		if i < 0 || !strings.HasPrefix(ref[i+1:], "ctx-") {
+			continue
+		}
+
+		if repo := ref[:i]; kept[repo] < keep {
+			kept[repo]++
+			continue
+		}
+
+		old = append(old, ref)
+	}
+
+	if len(old) == 0 {
+		return nil
+	}
+
+	// Images still used by containers are left alone
+	msg(fmt.Sprintf("Removing %d old image(s) on %v", len(old), host))
+	if err, _, stderr := host.docker(veryverbose, append([]string{"rmi"}, old...)...); err != nil {
+		msg(fmt.Sprintf("Removing images failed: %v\n%s", err, stderr.String()))
+	}
+
+	return nil
+}
+
+// Remove resources labeled by cirunner, optionally limited to a build name,
+// id and resources of builds started at least olderThan ago
+func removeResources(host *DockerHost, name, id string, olderThan time.Duration) error {
+	filters := []string{"--filter", "label=" + labelBuild}
+	if name != "" {
+		filters = []string{"--filter", "label=" + labelBuild + "=" + name}
+	}
+	if id != "" {
+		filters = append(filters, "--filter", "label="+labelID+"="+id)
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+
+	for _, kind := range resourceKinds {
+		err, stdout, stderr := host.docker(veryverbose, append(kind.list, filters...)...)
+		if err != nil {
+			return fmt.Errorf("Listing %ss failed: %v\n%s", kind.name, err, stderr.String())
+		}
+
+		ids := uniqueFields(stdout.String())
+		if len(ids) == 0 {
+			continue
+		}
+
+		if olderThan > 0 {
+			ids, err = startedBefore(host, kind, ids, cutoff)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		msg(fmt.Sprintf("Removing %d %s(s) on %v", len(ids), kind.name, host))
+		if err, _, stderr := host.docker(veryverbose, append(kind.rm, ids...)...); err != nil {
+			msg(fmt.Sprintf("Removing %ss failed: %v\n%s", kind.name, err, stderr.String()))
+		}
+	}
+
+	return nil
+}
+
+// Filter ids to resources whose build was started before cutoff
+func startedBefore(host *DockerHost, kind resourceKind, ids []string, cutoff time.Time) ([]string, error) {
+	format := fmt.Sprintf("{{%s}} {{index %s %q}}", kind.id, kind.labels, labelStarted)
+	args := append([]string{"inspect", "--type", kind.name, "--format", format}, ids...)
+
+	err, stdout, stderr := host.docker(veryverbose, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Inspecting %ss failed: %v\n%s", kind.name, err, stderr.String())
+	}
+
+	result := make([]string, 0)
+
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		started, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if time.Unix(started, 0).Before(cutoff) {
+			result = append(result, fields[0])
+		}
+	}
+
+	return result, nil
+}
+
+func uniqueFields(s string) []string {
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, f := range strings.Fields(s) {
+		if !seen[f] {
+			seen[f] = true
+			result = append(result, f)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Config file looked for in the build directory when --config isn't given
+const defaultConfig = "cirunner.json"
+
+// Config holds the settings of a project that live in its repository
+type Config struct {
+	Caches    []CacheVolume    `json:"caches"`
+	Prepare   *PrepareStep     `json:"prepare"`
+	Suites    []Suite          `json:"suites"`
+	Policy    Policy           `json:"policy"`
+	Impact    ImpactConfig     `json:"impact"`
+	Coverage  *CoverageConfig  `json:"coverage"`
+	Artifacts *ArtifactsConfig `json:"artifacts"`
+}
+
+// CacheVolume is a named volume mounted at path in migration and test
+// containers, persisting across runs and builds
+type CacheVolume struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// PrepareStep is a command run once in the image before runs start, like
+// compiling assets. Its result is committed as the image runs use, or when
+// path is set, shared with runs through a volume mounted there.
+type PrepareStep struct {
+	Command []string `json:"command"`
+	Path    string   `json:"path"`
+}
+
+// Suite is a set of features, selected by feature tags, that runs in a run
+// of its own
+type Suite struct {
+	Name        string   `json:"name"`
+	Tags        []string `json:"tags"`
+	NonBlocking bool     `json:"non_blocking"`
+}
+
+// Policy decides the exit code of a build from the results of its runs
+type Policy struct {
+	// Number of failed tests tolerated before the build fails
+	AllowedFailures int `json:"allowed_failures"`
+
+	// Infrastructure errors make the build "unstable" instead of failing it
+	InfraUnstable bool `json:"infra_unstable"`
+
+	// Exit code of unstable builds
+	UnstableExitCode int `json:"unstable_exit_code"`
+}
+
+var cacheNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Load the config file at path, relative paths are relative to dir. When
+// path is empty the default config is used if dir has one.
+func loadConfig(dir, path string) (*Config, error) {
+	config := &Config{}
+
+	optional := path == ""
+	if optional {
+		path = defaultConfig
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && optional {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(config); err != nil {
+		return nil, fmt.Errorf("Reading config %s failed: %v", path, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %v", path, err)
+	}
+
+	return config, nil
+}
+
+func (config *Config) validate() error {
+	names := make([]string, 0)
+
+	for _, cache := range config.Caches {
+		if !cacheNameRe.MatchString(cache.Name) {
+			return fmt.Errorf("invalid cache name %q", cache.Name)
+		}
+
+		if contains(names, cache.Name) {
+			return fmt.Errorf("duplicate cache %s", cache.Name)
+		}
+		names = append(names, cache.Name)
+
+		if !filepath.IsAbs(cache.Path) {
+			return fmt.Errorf("path of cache %s must be absolute", cache.Name)
+		}
+	}
+
+	suites := make([]string, 0)
+	for _, suite := range config.Suites {
+		// Suite runs are named after the suite, so it can't clash with others
+		_, err := strconv.Atoi(suite.Name)
+		if !cacheNameRe.MatchString(suite.Name) || suite.Name == "rspec" || err == nil {
+			return fmt.Errorf("invalid suite name %q", suite.Name)
+		}
+
+		if contains(suites, suite.Name) {
+			return fmt.Errorf("duplicate suite %s", suite.Name)
+		}
+		suites = append(suites, suite.Name)
+
+		if len(suite.Tags) == 0 {
+			return fmt.Errorf("suite %s without tags", suite.Name)
+		}
+	}
+
+	if config.Policy.AllowedFailures < 0 {
+		return fmt.Errorf("allowed failures can't be negative")
+	}
+
+	if config.Policy.UnstableExitCode == 0 {
+		config.Policy.UnstableExitCode = exitUnstable
+	}
+
+	if config.Coverage != nil {
+		if config.Coverage.Path == "" {
+			config.Coverage.Path = "coverage"
+		}
+
+		if filepath.IsAbs(config.Coverage.Path) || strings.HasPrefix(filepath.Clean(config.Coverage.Path), "..") {
+			return fmt.Errorf("coverage path must be inside the app")
+		}
+	}
+
+	if config.Artifacts != nil {
+		if err := config.Artifacts.validate(); err != nil {
+			return err
+		}
+	}
+
+	if config.Prepare != nil {
+		if len(config.Prepare.Command) == 0 {
+			return fmt.Errorf("prepare step without command")
+		}
+
+		if config.Prepare.Path != "" && !filepath.IsAbs(config.Prepare.Path) {
+			return fmt.Errorf("path of prepare step must be absolute")
+		}
+	}
+
+	return nil
+}
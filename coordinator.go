@@ -0,0 +1,452 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tokenHeader = "X-Cirunner-Token"
+
+// Shortest lease TTL, heartbeats are sent every quarter of it
+const minLeaseTTL = time.Second
+
+// Build as sent to workers
+type WireBuild struct {
+	Name     string        `json:"name"`
+	ID       string        `json:"id"`
+	LeaseTTL time.Duration `json:"lease_ttl"`
+	Image    string        `json:"image,omitempty"`
+	// Image built from the coordinator's checkout, workers building their
+	// own have to end up with the same
+	Context string `json:"context,omitempty"`
+}
+
+// Split as sent to workers
+type WireSplit struct {
+	Run        string   `json:"run"`
+	Weight     int      `json:"weight"`
+	Cmd        []string `json:"cmd"`
+	ReportSrc  string   `json:"report_src"`
+	ReportDest string   `json:"report_dest"`
+}
+
+// RunResult as sent back by workers
+type WireResult struct {
+	Run       string        `json:"run"`
+	Status    Status        `json:"status"`
+	Comment   string        `json:"comment"`
+	Duration  time.Duration `json:"duration"`
+	Stdout    string        `json:"stdout"`
+	Stderr    string        `json:"stderr"`
+	Artifacts []string      `json:"artifacts"`
+}
+
+func (s Split) wire() WireSplit {
+	return WireSplit{
+		Run:        s.run,
+		Weight:     s.weight(),
+		Cmd:        s.cmd,
+		ReportSrc:  s.reportSrc,
+		ReportDest: s.reportDest,
+	}
+}
+
+func (w WireSplit) split() Split {
+	return Split{
+		run:        w.Run,
+		cmd:        w.Cmd,
+		reportSrc:  w.ReportSrc,
+		reportDest: w.ReportDest,
+	}
+}
+
+func (r RunResult) wire() WireResult {
+	return WireResult{
+		Run:       r.run,
+		Status:    r.status,
+		Comment:   r.comment,
+		Duration:  r.duration,
+		Stdout:    r.stdout.String(),
+		Stderr:    r.stderr.String(),
+		Artifacts: r.artifacts,
+	}
+}
+
+func (w WireResult) result() RunResult {
+	r := RunResult{
+		run:       w.Run,
+		status:    w.Status,
+		comment:   w.Comment,
+		duration:  w.Duration,
+		artifacts: w.Artifacts,
+	}
+	r.stdout.WriteString(w.Stdout)
+	r.stderr.WriteString(w.Stderr)
+
+	return r
+}
+
+// Coordinator serves the queue of a build to remote workers over HTTP
+type Coordinator struct {
+	ctx     context.Context
+	build   *Build
+	queue   *Queue
+	results *RunResults
+	splits  map[string]Split
+	token   string
+	ttl     time.Duration
+
+	// Workers seen, and whether they've been told the build is over
+	mu      sync.Mutex
+	workers map[string]bool
+}
+
+func NewCoordinator(ctx context.Context, b *Build, queue *Queue, results *RunResults, splits []Split, token string, ttl time.Duration) *Coordinator {
+	co := &Coordinator{
+		ctx:     ctx,
+		build:   b,
+		queue:   queue,
+		results: results,
+		splits:  make(map[string]Split),
+		token:   token,
+		ttl:     ttl,
+		workers: make(map[string]bool),
+	}
+
+	for _, s := range splits {
+		co.splits[s.run] = s
+	}
+
+	return co
+}
+
+// Listen serves the coordinator API on addr and requeues splits of workers
+// that went away
+func (co *Coordinator) Listen(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/build", co.handleBuild)
+	mux.HandleFunc("/lease", co.handleLease)
+	mux.HandleFunc("/heartbeat", co.handleHeartbeat)
+	mux.HandleFunc("/release", co.handleRelease)
+	mux.HandleFunc("/reports", co.handleReports)
+	mux.HandleFunc("/result", co.handleResult)
+
+	go func() {
+		ticker := time.NewTicker(co.ttl / 4)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			for _, run := range co.queue.Expire() {
+				msg(fmt.Sprintf("Lease of run %v expired, requeued", run))
+				dashboard.SetPhase(run, phaseQueued)
+			}
+		}
+	}()
+
+	return http.ListenAndServe(addr, co.authorize(mux))
+}
+
+// Drain keeps answering workers until all of them have been told the build
+// is over, or they had time to ask, so they stop instead of waiting for a
+// coordinator that's gone
+func (co *Coordinator) Drain() {
+	deadline := time.Now().Add(workerPoll + co.ttl)
+
+	for time.Now().Before(deadline) {
+		co.mu.Lock()
+		done := true
+		for _, gone := range co.workers {
+			done = done && gone
+		}
+		co.mu.Unlock()
+
+		if done {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Record that worker was seen, and whether it was told the build is over
+func (co *Coordinator) seen(worker string, gone bool) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	co.workers[worker] = co.workers[worker] || gone
+}
+
+// Whether the build is over for workers
+func (co *Coordinator) over() bool {
+	return co.ctx.Err() != nil || co.queue.Finished()
+}
+
+func (co *Coordinator) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if co.token != "" && r.Header.Get(tokenHeader) != co.token {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (co *Coordinator) handleBuild(w http.ResponseWriter, r *http.Request) {
+	co.seen(r.URL.Query().Get("worker"), false)
+
+	info := WireBuild{
+		Name:     co.build.name,
+		ID:       co.build.id,
+		LeaseTTL: co.ttl,
+	}
+
+	// Workers run a pre-built image too instead of building their checkout.
+	// It's sent as given, prepared images are local to each host and
+	// workers prepare their own.
+	if co.build.docker.prebuilt {
+		info.Image = co.build.baseImage
+	} else {
+		info.Context = co.build.baseImage
+	}
+
+	writeJSON(w, info)
+}
+
+func (co *Coordinator) handleLease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	worker := r.URL.Query().Get("worker")
+	if co.over() {
+		co.seen(worker, true)
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	co.seen(worker, false)
+
+	s, ok := co.queue.Lease(worker, co.ttl)
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	msg(fmt.Sprintf("Run %v leased by %v", s.run, worker))
+	dashboard.SetPhase(s.run, "running on "+worker)
+	writeJSON(w, s.wire())
+}
+
+func (co *Coordinator) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	if co.over() {
+		co.seen(q.Get("worker"), true)
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	if !co.queue.Heartbeat(q.Get("worker"), q.Get("run"), co.ttl) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (co *Coordinator) handleRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	if !co.queue.Release(q.Get("worker"), q.Get("run")) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	msg(fmt.Sprintf("Run %v released by %v, requeued", q.Get("run"), q.Get("worker")))
+	dashboard.SetPhase(q.Get("run"), phaseQueued)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (co *Coordinator) handleReports(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s, ok := co.splits[q.Get("run")]
+	if r.Method != "POST" || !ok {
+		http.Error(w, "unknown run", http.StatusBadRequest)
+		return
+	}
+
+	// Reports of a worker that lost the lease would replace those of the
+	// run that counts
+	if !co.queue.Holds(q.Get("worker"), s.run) {
+		http.Error(w, "lease not held", http.StatusConflict)
+		return
+	}
+
+	dest := s.reportDir()
+	switch q.Get("kind") {
+	case "coverage":
+		if co.build.config.Coverage != nil {
+			dest = co.build.coverageDir(s.run)
+		}
+	case "artifacts":
+		dest = co.build.artifactDir(s.run)
+	}
+
+	if err := untarDir(r.Body, dest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (co *Coordinator) handleResult(w http.ResponseWriter, r *http.Request) {
+	var result WireResult
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := co.splits[result.Run]; r.Method != "POST" || !ok {
+		http.Error(w, "unknown run", http.StatusBadRequest)
+		return
+	}
+
+	worker := r.URL.Query().Get("worker")
+	if !co.queue.Holds(worker, result.Run) {
+		http.Error(w, "lease not held", http.StatusConflict)
+		return
+	}
+
+	msg(fmt.Sprintf("Run %v %s on %v", result.Run, result.Status, worker))
+
+	registerResult(co.results, result.result())
+	co.queue.Complete(result.Run)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// Write the contents of dir as a gzipped tarball
+func tarDir(dir string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// Extract a gzipped tarball written by tarDir into dir
+func untarDir(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(path, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("Invalid path %s in reports", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0777); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				return err
+			}
+
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/krisrang/cirunner/simplecov"
+)
+
+// CoverageConfig collects the SimpleCov results of every run
+type CoverageConfig struct {
+	// Directory SimpleCov writes to, relative to the app
+	Path string `json:"path"`
+
+	// Keep a map of source files to the test files covering them for
+	// --changed-since, which needs every test file to have a SimpleCov
+	// command name of its own like "RSpec spec/models/user_spec.rb"
+	Map bool `json:"map"`
+}
+
+// CoverageMap maps source files to the feature and spec files covering them
+type CoverageMap struct {
+	Updated time.Time           `json:"updated"`
+	Sources map[string][]string `json:"sources"`
+}
+
+// Directory the coverage results of run are copied to
+func (b *Build) coverageDir(run string) string {
+	return filepath.Join(b.config.Coverage.Path, "runs", run)
+}
+
+// Where the coverage map of the project is kept between builds
+func (b *Build) coverageMapPath() string {
+	return filepath.Join(b.dataDir, b.name, "coverage-map.json")
+}
+
+// Read the coverage map at path, which is empty until the first build
+// that collects coverage
+func loadCoverageMap(path string) (*CoverageMap, error) {
+	m := &CoverageMap{Sources: make(map[string][]string)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		return nil, fmt.Errorf("Reading coverage map %s failed: %v", path, err)
+	}
+
+	return m, nil
+}
+
+func (m *CoverageMap) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write through a temporary file so concurrent builds never read a
+	// partial map
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Replace the sources covered by the test files in resultsets, leaving
+// those of test files that didn't run alone
+func (m *CoverageMap) update(resultsets []simplecov.Resultset) int {
+	covered := make(map[string]map[string]bool)
+
+	for _, rs := range resultsets {
+		for command, result := range rs {
+			test := testFile(command)
+			if test == "" {
+				continue
+			}
+
+			if covered[test] == nil {
+				covered[test] = make(map[string]bool)
+			}
+
+			for source, fc := range result.Coverage {
+				if fc.Covered() {
+					covered[test][appPath(source)] = true
+				}
+			}
+		}
+	}
+
+	for source, tests := range m.Sources {
+		kept := make([]string, 0, len(tests))
+		for _, test := range tests {
+			if covered[test] == nil {
+				kept = append(kept, test)
+			}
+		}
+		m.Sources[source] = kept
+	}
+
+	for test, sources := range covered {
+		for source := range sources {
+			m.Sources[source] = append(m.Sources[source], test)
+		}
+	}
+
+	for source, tests := range m.Sources {
+		if len(tests) == 0 {
+			delete(m.Sources, source)
+			continue
+		}
+		sort.Strings(tests)
+	}
+
+	m.Updated = time.Now()
+	return len(covered)
+}
+
+// Test files covering source
+func (m *CoverageMap) tests(source string) []string {
+	return m.Sources[source]
+}
+
+// Test file a SimpleCov command name is for, empty if it isn't for one
+func testFile(command string) string {
+	fields := strings.Fields(command)
+
+	for i := len(fields) - 1; i >= 0; i-- {
+		if strings.HasSuffix(fields[i], ".feature") || strings.HasSuffix(fields[i], "_spec.rb") {
+			return appPath(fields[i])
+		}
+	}
+
+	return ""
+}
+
+// Path of a file of the app relative to it, SimpleCov uses absolute paths
+// inside the container
+func appPath(path string) string {
+	path = strings.TrimPrefix(path, "/app/")
+	return strings.TrimPrefix(path, "./")
+}
+
+// Update the coverage map with the coverage of the runs of a full build
+func (b *Build) updateCoverageMap() error {
+	resultsets, err := simplecov.ParseDir(filepath.Join(b.config.Coverage.Path, "runs"))
+	if err != nil {
+		return err
+	}
+
+	path := b.coverageMapPath()
+	m, err := loadCoverageMap(path)
+	if err != nil {
+		return err
+	}
+
+	tests := m.update(resultsets)
+	if tests == 0 {
+		msg("No per test file coverage found, is SimpleCov given a command name for every test file?")
+		return nil
+	}
+
+	msg(fmt.Sprintf("Updated coverage map %s with %d test file(s)", path, tests))
+	return m.save(path)
+}
+
+// Merge the coverage of all runs into a single resultset and a Cobertura
+// report in the coverage path
+func (b *Build) mergeCoverage() error {
+	cov := b.config.Coverage
+
+	resultsets, err := simplecov.ParseDir(filepath.Join(cov.Path, "runs"))
+	if err != nil {
+		return err
+	}
+
+	if len(resultsets) == 0 {
+		msg("No coverage results found")
+		return nil
+	}
+
+	merged := simplecov.Merge(resultsets, "cirunner "+b.id)
+	if err := merged.WriteFile(filepath.Join(cov.Path, ".resultset.json")); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(cov.Path, "coverage.xml"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	result := merged["cirunner "+b.id]
+	if err := result.WriteCobertura(f, "/app"); err != nil {
+		return err
+	}
+
+	covered, valid := result.Lines()
+	msg(fmt.Sprintf("Merged coverage of %d run(s), %d of %d lines covered", len(resultsets), covered, valid))
+
+	return nil
+}
@@ -51,7 +51,12 @@ func (t *Tags) Include(feature *gherkin.Feature) bool {
 	return true
 }
 
-func Select(tags Tags) ([]FeatureFile, error) {
+// Filter decides whether a feature file is selected
+type Filter func(path string, feature *gherkin.Feature) bool
+
+// Select finds feature files included by tags and all filters, weighed by
+// their steps
+func Select(tags Tags, filters ...Filter) ([]FeatureFile, error) {
 	features := make([]FeatureFile, 0)
 	files := make([]string, 0)
 
@@ -78,7 +83,7 @@ func Select(tags Tags) ([]FeatureFile, error) {
 			return nil, err
 		}
 
-		if tags.Include(parsedFeature) {
+		if tags.Include(parsedFeature) && accept(filters, f, parsedFeature) {
 			weight := 0
 
 			for _, d := range parsedFeature.ScenarioDefinitions {
@@ -116,6 +121,60 @@ func Select(tags Tags) ([]FeatureFile, error) {
 	return features, nil
 }
 
+func accept(filters []Filter, path string, feature *gherkin.Feature) bool {
+	for _, filter := range filters {
+		if !filter(path, feature) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// StepTexts returns the texts of all steps of feature, including its
+// background, with scenario outlines expanded for each of their examples
+func StepTexts(feature *gherkin.Feature) []string {
+	texts := make([]string, 0)
+
+	if feature.Background != nil {
+		for _, step := range feature.Background.Steps {
+			texts = append(texts, step.Text)
+		}
+	}
+
+	for _, d := range feature.ScenarioDefinitions {
+		if scenario, ok := d.(*gherkin.Scenario); ok {
+			for _, step := range scenario.Steps {
+				texts = append(texts, step.Text)
+			}
+		}
+
+		if outline, ok := d.(*gherkin.ScenarioOutline); ok {
+			for _, e := range outline.Examples {
+				if e.TableHeader == nil {
+					continue
+				}
+
+				for _, row := range e.TableBody {
+					for _, step := range outline.Steps {
+						text := step.Text
+
+						for i, cell := range e.TableHeader.Cells {
+							if i < len(row.Cells) {
+								text = strings.Replace(text, "<"+cell.Value+">", row.Cells[i].Value, -1)
+							}
+						}
+
+						texts = append(texts, text)
+					}
+				}
+			}
+		}
+	}
+
+	return texts
+}
+
 func ParseTags(tags []string, slow []string) Tags {
 	parsedTags := Tags{
 		SelectTags: make([]string, 0),
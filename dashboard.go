@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/pebblescape/pebblescape/pkg/table"
+)
+
+// Run phases shown on the dashboard
+const (
+	phaseQueued    = "queued"
+	phaseRedis     = "starting redis"
+	phaseMigrating = "migrating"
+	phaseRunning   = "running"
+	phaseReports   = "copying reports"
+	phasePassed    = "passed"
+	phaseFailed    = "failed"
+)
+
+type runState struct {
+	run     string
+	phase   string
+	weight  int
+	start   time.Time
+	running time.Time
+	end     time.Time
+	passed  int
+	failed  int
+	pending int
+}
+
+// Dashboard renders a live table of all runs to a terminal. All methods are
+// no-ops on a nil Dashboard, so callers don't need to care whether stdout is
+// a TTY.
+type Dashboard struct {
+	sync.Mutex
+	out   io.Writer
+	runs  []*runState
+	index map[string]*runState
+	lines int
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewDashboard(out io.Writer) *Dashboard {
+	return &Dashboard{
+		out:   out,
+		index: make(map[string]*runState),
+	}
+}
+
+// Is stdout attached to a terminal
+func isTerminal() bool {
+	fi, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Add registers a run, weight is the number of steps it's expected to run
+// and is used to estimate time left.
+func (d *Dashboard) Add(run string, weight int) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.index[run]; ok {
+		return
+	}
+
+	r := &runState{
+		run:    run,
+		phase:  phaseQueued,
+		weight: weight,
+	}
+	d.runs = append(d.runs, r)
+	d.index[run] = r
+}
+
+func (d *Dashboard) SetPhase(run, phase string) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	r, ok := d.index[run]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	if r.start.IsZero() {
+		r.start = now
+	}
+
+	switch phase {
+	case phaseRunning:
+		r.running = now
+	case phasePassed, phaseFailed:
+		r.end = now
+	}
+
+	r.phase = phase
+}
+
+// Progress returns a writer parsing cucumber/rspec progress formatter output
+// of run, or nil when there is no dashboard.
+func (d *Dashboard) Progress(run string) io.Writer {
+	if d == nil {
+		return nil
+	}
+
+	return &progressWriter{dash: d, run: run, valid: true}
+}
+
+func (d *Dashboard) Start() {
+	if d == nil {
+		return
+	}
+
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			d.Lock()
+			d.draw()
+			d.Unlock()
+
+			select {
+			case <-ticker.C:
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop draws the final state of the dashboard and stops redrawing it.
+func (d *Dashboard) Stop() {
+	if d == nil || d.stop == nil {
+		return
+	}
+
+	close(d.stop)
+	<-d.done
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.draw()
+	d.lines = 0
+	d.stop = nil
+}
+
+// Write prints p above the dashboard.
+func (d *Dashboard) Write(p []byte) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.clear()
+	d.out.Write(p)
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		d.out.Write([]byte{'\n'})
+	}
+	d.draw()
+
+	return len(p), nil
+}
+
+func (d *Dashboard) clear() {
+	if d.lines > 0 {
+		fmt.Fprintf(d.out, "\x1b[%dA\x1b[J", d.lines)
+		d.lines = 0
+	}
+}
+
+func (d *Dashboard) draw() {
+	if d.stop == nil {
+		return
+	}
+
+	d.clear()
+
+	// Progress formatters print a character per cucumber step or rspec
+	// example rather than per scenario, so that's what is counted
+	tbl := table.New(7)
+	tbl.Add("RUN", "PHASE", "ELAPSED", "STEPS PASSED", "STEPS FAILED", "STEPS PENDING", "ETA")
+
+	for _, r := range d.runs {
+		elapsed, eta := "", ""
+
+		if !r.start.IsZero() {
+			end := r.end
+			if end.IsZero() {
+				end = time.Now()
+			}
+			elapsed = formatDuration(end.Sub(r.start))
+		}
+
+		done := r.passed + r.failed + r.pending
+		if r.phase == phaseRunning && r.weight > 0 && done > 0 && done < r.weight {
+			spent := time.Since(r.running)
+			eta = formatDuration(spent * time.Duration(r.weight-done) / time.Duration(done))
+		}
+
+		tbl.Add(r.run, r.phase, elapsed, strconv.Itoa(r.passed), strconv.Itoa(r.failed), strconv.Itoa(r.pending), eta)
+	}
+
+	out := tbl.String()
+	fmt.Fprint(d.out, out)
+	d.lines = bytes.Count([]byte(out), []byte{'\n'})
+}
+
+// Counts progress characters of a run, which are steps of features and
+// examples of specs. Only lines made up entirely of
+// progress characters are counted, so summaries and stack traces following
+// the progress line don't skew the numbers.
+type progressWriter struct {
+	dash   *Dashboard
+	run    string
+	escape bool
+	valid  bool
+	line   runState
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.dash.Lock()
+	defer w.dash.Unlock()
+
+	r, ok := w.dash.index[w.run]
+	if !ok {
+		return len(p), nil
+	}
+
+	for _, c := range p {
+		if w.escape {
+			// ANSI color sequences end with a letter
+			if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+				w.escape = false
+			}
+			continue
+		}
+
+		switch c {
+		case 0x1b:
+			w.escape = true
+		case '\n':
+			w.line = runState{}
+			w.valid = true
+		case '\r':
+		case '.':
+			w.count(&r.passed, &w.line.passed)
+		case 'F':
+			w.count(&r.failed, &w.line.failed)
+		case '-', '*', 'P', 'U':
+			w.count(&r.pending, &w.line.pending)
+		default:
+			if w.valid {
+				// Not a progress line after all, take back what was counted
+				r.passed -= w.line.passed
+				r.failed -= w.line.failed
+				r.pending -= w.line.pending
+				w.line = runState{}
+				w.valid = false
+			}
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *progressWriter) count(total, line *int) {
+	if w.valid {
+		*total++
+		*line++
+	}
+}
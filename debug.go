@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/codegangsta/cli"
+)
+
+var debugCommand = cli.Command{
+	Name:  "debug",
+	Usage: "open a shell in the committed container of a failed run",
+	Description: "Takes the run to debug as argument, the build is given by --name and --id.\n" +
+		"   Starts fresh database and redis containers, migrates the database and opens\n" +
+		"   a shell in the image committed by --commit with the same environment and\n" +
+		"   links the run had.",
+	Action: debug,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "shell",
+			Value: "bash",
+			Usage: "shell to run in the container",
+		},
+	},
+}
+
+func debug(c *cli.Context) {
+	verbose = c.GlobalBool("verbose")
+	veryverbose = c.GlobalBool("veryverbose")
+
+	if c.GlobalString("id") == "" {
+		log.Fatal("Must specify id of the build to debug")
+	}
+
+	if len(c.Args()) != 1 {
+		log.Fatal("Must specify run to debug")
+	}
+
+	b, err := newBuild(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := c.Args().First()
+	b.image = b.container(failed)
+
+	// Failed runs are committed on the host they ran on, which has to be
+	// given as the only --docker-host
+	h := b.hosts[0]
+	b.hosts = b.hosts[:1]
+
+	if err, _, _ := h.docker(veryverbose, "image", "inspect", b.image); err != nil {
+		log.Fatal(fmt.Errorf("No committed image %s found, was the build run with --commit?", b.image))
+	}
+
+	if err := debugRun(b, h, failed, c.String("shell")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func debugRun(b *Build, h *DockerHost, failed, shell string) error {
+	// Debug containers get names of their own so they don't clash with
+	// the build should it still be running
+	run := failed + "-debug"
+	h.dbcnt = b.container(run) + "-db"
+
+	defer h.resources.Teardown()
+
+	if err := b.createCaches(); err != nil {
+		return err
+	}
+
+	topic("Starting database")
+	if err := b.startDB(); err != nil {
+		return err
+	}
+
+	topic("Starting redis")
+	h.docker(veryverbose, "rm", "-f", "-v", b.redisContainer(run))
+	h.resources.Track(kindContainer, b.redisContainer(run))
+	if err, stdout, stderr := h.docker(veryverbose, b.redisArgs(run)...); err != nil {
+		return fmt.Errorf("Starting redis failed: %v\n%s\n%s", err, stdout.String(), stderr.String())
+	}
+
+	topic("Migrating database")
+	h.resources.Track(kindContainer, b.migrateContainer(run))
+	if err, stdout, stderr := h.docker(verbose, b.migrateArgs(h, run)...); err != nil {
+		return fmt.Errorf("Migrating DB failed: %v\n%s\n%s", err, stdout.String(), stderr.String())
+	}
+
+	topic(fmt.Sprintf("Opening %s in %s, exit the shell to clean up", shell, b.image))
+	h.resources.Track(kindContainer, b.container(run))
+	args := append([]string{"run", "-it", "--rm", "--name", b.container(run)}, b.labels()...)
+	args = append(args, b.envArgs(h, run)...)
+	args = append(args, b.image, shell)
+
+	cmd := exec.Command("docker", h.args(args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		msg(fmt.Sprintf("Shell exited: %v", err))
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/codegangsta/cli"
+)
+
+// DockerHost is a docker endpoint runs are scheduled on, each with its own
+// database container and resources
+type DockerHost struct {
+	url       string
+	capacity  int
+	dbcnt     string
+	resources *Registry
+}
+
+func NewDockerHost(url string, capacity int) *DockerHost {
+	h := &DockerHost{
+		url:      url,
+		capacity: capacity,
+	}
+	h.resources = NewRegistry(h)
+
+	return h
+}
+
+// Parse hosts given as DOCKER_HOST style URLs with an optional capacity,
+// like tcp://10.0.0.2:2376=4, hosts without one get capacity. Without hosts
+// the default docker host is used with defaultCapacity.
+func parseHosts(c *cli.Context, capacity, defaultCapacity int) ([]*DockerHost, error) {
+	hosts := make([]*DockerHost, 0)
+
+	for _, arg := range c.GlobalStringSlice("docker-host") {
+		url, hostCapacity := arg, capacity
+
+		if i := strings.LastIndex(arg, "="); i >= 0 {
+			n, err := strconv.Atoi(arg[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("Invalid capacity in docker host %s", arg)
+			}
+			url, hostCapacity = arg[:i], n
+		}
+
+		hosts = append(hosts, NewDockerHost(url, hostCapacity))
+	}
+
+	if len(hosts) == 0 {
+		hosts = append(hosts, NewDockerHost("", defaultCapacity))
+	}
+
+	return hosts, nil
+}
+
+func (h *DockerHost) String() string {
+	if h.url == "" {
+		return "local"
+	}
+
+	return h.url
+}
+
+// Arguments to docker targeting this host
+func (h *DockerHost) args(args ...string) []string {
+	if h.url == "" {
+		return args
+	}
+
+	return append([]string{"-H", h.url}, args...)
+}
+
+func (h *DockerHost) docker(pipe bool, args ...string) (error, bytes.Buffer, bytes.Buffer) {
+	return runCmd(pipe, "docker", h.args(args...)...)
+}
+
+func (h *DockerHost) dockerTo(stdout, stderr io.Writer, args ...string) (error, bytes.Buffer, bytes.Buffer) {
+	return runCmdTo(stdout, stderr, "docker", h.args(args...)...)
+}
+
+// Run fn on all hosts in parallel, returning the first error
+func eachHost(hosts []*DockerHost, fn func(h *DockerHost) error) error {
+	errs := make([]error, len(hosts))
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(hosts))
+
+	for i, h := range hosts {
+		go func(i int, h *DockerHost) {
+			defer wg.Done()
+
+			if err := fn(h); err != nil {
+				errs[i] = fmt.Errorf("%v: %v", h, err)
+			}
+		}(i, h)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
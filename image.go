@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ImageOptions are the settings the image of a build is built or pulled with
+type ImageOptions struct {
+	prebuilt   bool
+	registry   string
+	dockerfile string
+	target     string
+	buildArgs  []string
+	tags       []string
+	pull       bool
+	noCache    bool
+}
+
+// Resolve bare KEY build arguments to KEY=value from the environment the
+// way docker does, so they're part of the image hash
+func resolveBuildArgs(args []string) []string {
+	resolved := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		if !strings.Contains(arg, "=") {
+			value, ok := os.LookupEnv(arg)
+			if !ok {
+				continue
+			}
+			arg += "=" + value
+		}
+
+		resolved = append(resolved, arg)
+	}
+
+	return resolved
+}
+
+// Arguments to docker build the image with tags and labels
+func (o ImageOptions) args(tags, labels []string) []string {
+	args := []string{"build", "-f", o.dockerfile}
+
+	for _, tag := range tags {
+		args = append(args, "-t", tag)
+	}
+
+	args = append(args, labels...)
+
+	if o.target != "" {
+		args = append(args, "--target", o.target)
+	}
+
+	for _, arg := range o.buildArgs {
+		args = append(args, "--build-arg", arg)
+	}
+
+	if o.pull {
+		args = append(args, "--pull")
+	}
+
+	if o.noCache {
+		args = append(args, "--no-cache")
+	}
+
+	return append(args, ".")
+}
+
+// Reference to pull image by, images without a registry of their own are
+// pulled from the configured one
+func (o ImageOptions) remote(image string) string {
+	if o.registry == "" {
+		return image
+	}
+
+	if i := strings.Index(image, "/"); i >= 0 {
+		if host := image[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+			return image
+		}
+	}
+
+	return o.registry + "/" + image
+}
+
+// Whether the image has to be built even if one of the same context exists
+func (o ImageOptions) fresh() bool {
+	return o.pull || o.noCache
+}
+
+// Hash of the context hash and the options that change the image built
+// from it
+func (o ImageOptions) hash(context string) string {
+	args := append([]string{}, o.buildArgs...)
+	sort.Strings(args)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s", context, o.dockerfile, o.target, strings.Join(args, "\x00"))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type ignorePattern struct {
+	re     *regexp.Regexp
+	negate bool
+}
+
+// Read the patterns of the .dockerignore in dir, a missing file ignores
+// nothing
+func readDockerignore(dir string) ([]ignorePattern, error) {
+	f, err := os.Open(filepath.Join(dir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := make([]ignorePattern, 0)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = strings.TrimSpace(line[1:])
+		}
+
+		line = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(line)), "/")
+
+		re, err := globRegexp(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid .dockerignore pattern %s: %v", line, err)
+		}
+		p.re = re
+
+		patterns = append(patterns, p)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// Translate a .dockerignore glob to a regexp, ** matches any number of
+// directories
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					re.WriteString("(.*/)?")
+				} else {
+					re.WriteString(".*")
+				}
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(pattern[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated [")
+			}
+			re.WriteString(pattern[i : i+j+1])
+			i += j
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				re.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// Whether path relative to the context is excluded, the last matching
+// pattern wins and a path is excluded along with its parent directory
+func ignored(patterns []ignorePattern, path string) bool {
+	excluded := false
+
+	for _, p := range patterns {
+		matched := false
+		for parent := path; parent != "." && !matched; parent = filepath.Dir(parent) {
+			matched = p.re.MatchString(filepath.ToSlash(parent))
+		}
+
+		if matched {
+			excluded = !p.negate
+		}
+	}
+
+	return excluded
+}
+
+// Hash of the files docker would send as build context of dir along with
+// the Dockerfile, which is part of it even if ignored
+func contextHash(dir, dockerfile string) (string, error) {
+	dockerfile = filepath.Clean(dockerfile)
+
+	patterns, err := readDockerignore(dir)
+	if err != nil {
+		return "", err
+	}
+
+	files := make([]string, 0)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		// Negated patterns may bring back files of ignored directories, so
+		// only skip directories without any
+		if ignored(patterns, rel) {
+			if info.IsDir() && !hasNegation(patterns) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.IsDir() {
+			files = append(files, rel)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if !contains(files, dockerfile) {
+		files = append(files, dockerfile)
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, rel := range files {
+		if err := hashFile(h, dir, rel); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hasNegation(patterns []ignorePattern) bool {
+	for _, p := range patterns {
+		if p.negate {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hashFile(h io.Writer, dir, rel string) error {
+	path := filepath.Join(dir, rel)
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(h, "%s\x00%o\x00", filepath.ToSlash(rel), info.Mode())
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		io.WriteString(h, target)
+	case info.Mode().IsRegular():
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+	}
+
+	h.Write([]byte{0})
+	return nil
+}
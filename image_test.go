@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{"tmp", "tmp", true},
+		{"tmp", "tmpfile", false},
+		{"*.log", "test.log", true},
+		{"*.log", "log/test.log", false},
+		{"log/*", "log/test.log", true},
+		{"log/*", "log/a/test.log", false},
+		{"**/*.png", "shot.png", true},
+		{"**/*.png", "tmp/screenshots/shot.png", true},
+		{"tmp/**", "tmp/a/b", true},
+		{"file?.txt", "file1.txt", true},
+		{"file?.txt", "file/.txt", false},
+		{"file[0-9].txt", "file3.txt", true},
+		{"file[0-9].txt", "filex.txt", false},
+		{`\*.txt`, "*.txt", true},
+		{`\*.txt`, "a.txt", false},
+		{"a.b", "axb", false},
+	}
+
+	for _, tt := range tests {
+		re, err := globRegexp(tt.glob)
+		if err != nil {
+			t.Errorf("globRegexp(%q): %v", tt.glob, err)
+			continue
+		}
+
+		if got := re.MatchString(tt.path); got != tt.match {
+			t.Errorf("globRegexp(%q) matching %q = %v, want %v", tt.glob, tt.path, got, tt.match)
+		}
+	}
+
+	if _, err := globRegexp("file[0-9.txt"); err == nil {
+		t.Errorf("globRegexp with an unterminated [ succeeded")
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, ".dockerignore", "# comment\n\nlog\n/tmp/*\n*.md\n!README.md\n")
+
+	patterns, err := readDockerignore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{"log", true},
+		{"log/test.log", true},
+		{"app/log", false},
+		{"tmp/cache", true},
+		{"tmp/cache/file", true},
+		{"tmp", false},
+		{"CHANGELOG.md", true},
+		{"README.md", false},
+		{"docs/guide.md", false},
+		{"app/models/user.rb", false},
+	}
+
+	for _, tt := range tests {
+		if got := ignored(patterns, tt.path); got != tt.ignored {
+			t.Errorf("ignored(%q) = %v, want %v", tt.path, got, tt.ignored)
+		}
+	}
+}
+
+func TestContextHash(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, ".dockerignore", "log\nDockerfile\n")
+	writeFile(t, dir, "Dockerfile", "FROM ruby\n")
+	writeFile(t, dir, "app/models/user.rb", "class User; end\n")
+	writeFile(t, dir, "log/test.log", "started\n")
+
+	hash := func() string {
+		h, err := contextHash(dir, "Dockerfile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	base := hash()
+	if base != hash() {
+		t.Fatalf("contextHash differs for the same context")
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		changes bool
+	}{
+		{"ignored file changed", "log/test.log", "finished\n", false},
+		{"ignored file added", "log/other.log", "started\n", false},
+		{"ignored dockerfile changed", "Dockerfile", "FROM ruby:2.3\n", true},
+		{"file changed", "app/models/user.rb", "class User; def x; end; end\n", true},
+		{"file added", "app/models/post.rb", "class Post; end\n", true},
+	}
+
+	for _, tt := range tests {
+		writeFile(t, dir, tt.file, tt.content)
+
+		got := hash()
+		if changed := got != base; changed != tt.changes {
+			t.Errorf("%s: hash changed = %v, want %v", tt.name, changed, tt.changes)
+		}
+		base = got
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cirunner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
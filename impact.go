@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/cucumber/gherkin-go"
+	"github.com/krisrang/cirunner/cucumber"
+	"github.com/krisrang/cirunner/rspec"
+)
+
+// ImpactConfig configures which tests --changed-since selects for changed
+// files besides features and specs changed themselves
+type ImpactConfig struct {
+	// Changes to files matching these globs run everything
+	RunAll []string `json:"run_all"`
+
+	Mappings []ImpactMapping `json:"mappings"`
+}
+
+// ImpactMapping selects specs and features for changed files matching
+// pattern, a regexp whose groups can be used in the globs like $1
+type ImpactMapping struct {
+	Pattern  string   `json:"pattern"`
+	Specs    []string `json:"specs"`
+	Features []string `json:"features"`
+}
+
+// Files that run everything when changed unless configured otherwise
+var defaultRunAll = []string{
+	"Gemfile",
+	"Gemfile.lock",
+	"Dockerfile",
+	"db/schema.rb",
+	"db/structure.sql",
+	"config/**",
+}
+
+// Impact holds the tests affected by the changes since a git ref
+type Impact struct {
+	changed     []string
+	allFeatures bool
+	allSpecs    bool
+	features    []*regexp.Regexp
+	specs       []*regexp.Regexp
+	steps       []*regexp.Regexp
+}
+
+var stepDefRe = regexp.MustCompile(`^\s*(Given|When|Then|And|But|Step)\s*\(?\s*(/(.*)/[a-z]*|"(.*)"|'(.*)')`)
+var cucumberParamRe = regexp.MustCompile(`\\\{[^}]*\\\}`)
+var cucumberOptionalRe = regexp.MustCompile(`\\\(([^)]*)\\\)`)
+
+// Group references like $1 in mapping globs, which are usually followed by
+// more of the path
+var groupRefRe = regexp.MustCompile(`\$(\d+)`)
+
+// Files changed since ref, relative to the build directory. Changes are
+// taken from where the current branch forked off ref, including ones not
+// yet committed and new files.
+func changedFiles(ref string) ([]string, error) {
+	err, stdout, stderr := runCmd(veryverbose, "git", "merge-base", ref, "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("Finding merge base with %s failed: %v\n%s", ref, err, stderr.String())
+	}
+	base := strings.TrimSpace(stdout.String())
+
+	err, stdout, stderr = runCmd(veryverbose, "git", "diff", "--name-only", "--relative", base)
+	if err != nil {
+		return nil, fmt.Errorf("Listing changes since %s failed: %v\n%s", ref, err, stderr.String())
+	}
+
+	changed := uniqueFields(stdout.String())
+
+	// New files aren't in the diff until they're added
+	err, stdout, stderr = runCmd(veryverbose, "git", "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, fmt.Errorf("Listing new files failed: %v\n%s", err, stderr.String())
+	}
+
+	return append(changed, uniqueFields(stdout.String())...), nil
+}
+
+// Work out the tests affected by changes since the --changed-since ref
+func (b *Build) loadImpact() (*Impact, error) {
+	if b.impact != nil {
+		return b.impact, nil
+	}
+
+	changed, err := changedFiles(b.changedSince)
+	if err != nil {
+		return nil, err
+	}
+
+	msg(fmt.Sprintf("%d file(s) changed since %s", len(changed), b.changedSince))
+
+	i := &Impact{changed: changed}
+	config := b.config.Impact
+
+	runAll := config.RunAll
+	if len(runAll) == 0 {
+		runAll = defaultRunAll
+	}
+
+	// Coverage of earlier full builds tells which tests run changed files
+	var coverage *CoverageMap
+	if cov := b.config.Coverage; cov != nil && cov.Map {
+		coverage, err = loadCoverageMap(b.coverageMapPath())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range changed {
+		if coverage != nil {
+			for _, test := range coverage.tests(path) {
+				if strings.HasSuffix(test, ".feature") {
+					i.addFeatures(test)
+				} else {
+					i.addSpecs(test)
+				}
+			}
+		}
+
+		switch {
+		case matchesAny(runAll, path):
+			i.allFeatures = true
+			i.allSpecs = true
+		case strings.HasSuffix(path, ".feature"):
+			i.addFeatures(path)
+		case strings.HasPrefix(path, "features/support/"):
+			i.allFeatures = true
+		case strings.HasPrefix(path, "features/step_definitions/"):
+			if err := i.addSteps(path); err != nil {
+				msg(fmt.Sprintf("Running all features, can't tell which use %s: %v", path, err))
+				i.allFeatures = true
+			}
+		case strings.HasPrefix(path, "spec/support/") || path == "spec/spec_helper.rb" || path == "spec/rails_helper.rb":
+			i.allSpecs = true
+		case strings.HasPrefix(path, "spec/") && strings.HasSuffix(path, "_spec.rb"):
+			i.addSpecs(path)
+		}
+
+		for _, m := range config.Mappings {
+			re, err := regexp.Compile(m.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid impact mapping %s: %v", m.Pattern, err)
+			}
+
+			match := re.FindStringSubmatchIndex(path)
+			if match == nil {
+				continue
+			}
+
+			expand := func(globs []string) []string {
+				expanded := make([]string, 0, len(globs))
+				for _, g := range globs {
+					g = groupRefRe.ReplaceAllString(g, "$${$1}")
+					expanded = append(expanded, string(re.ExpandString(nil, g, path, match)))
+				}
+				return expanded
+			}
+
+			i.addSpecs(expand(m.Specs)...)
+			i.addFeatures(expand(m.Features)...)
+		}
+	}
+
+	b.impact = i
+	return i, nil
+}
+
+func (i *Impact) addFeatures(globs ...string) {
+	i.features = append(i.features, compileGlobs(globs)...)
+}
+
+func (i *Impact) addSpecs(globs ...string) {
+	i.specs = append(i.specs, compileGlobs(globs)...)
+}
+
+// Add the steps defined in a step definition file, so features using any
+// of them are selected
+func (i *Impact) addSteps(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := stepDefRe.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+
+		var pattern string
+		switch {
+		case m[3] != "":
+			pattern = m[3]
+		case m[4] != "":
+			pattern = cucumberExpression(m[4])
+		default:
+			pattern = cucumberExpression(m[5])
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("unsupported step pattern %s", pattern)
+		}
+
+		i.steps = append(i.steps, re)
+	}
+
+	return scanner.Err()
+}
+
+// Translate a cucumber expression to a regexp, parameters match anything
+func cucumberExpression(expr string) string {
+	re := regexp.QuoteMeta(expr)
+	re = cucumberParamRe.ReplaceAllString(re, ".*")
+	re = cucumberOptionalRe.ReplaceAllString(re, "(?:$1)?")
+
+	return "^" + re + "$"
+}
+
+// Filter selecting affected features
+func (i *Impact) featureFilter() cucumber.Filter {
+	return func(path string, feature *gherkin.Feature) bool {
+		if i.allFeatures || matchesRegexps(i.features, path) {
+			return true
+		}
+
+		if len(i.steps) > 0 {
+			for _, text := range cucumber.StepTexts(feature) {
+				if matchesRegexps(i.steps, text) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+}
+
+// Filter selecting affected specs
+func (i *Impact) specFilter() rspec.Filter {
+	return func(path string) bool {
+		return i.allSpecs || matchesRegexps(i.specs, path)
+	}
+}
+
+func compileGlobs(globs []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0, len(globs))
+
+	for _, g := range globs {
+		re, err := globRegexp(strings.TrimPrefix(filepath.ToSlash(filepath.Clean(g)), "/"))
+		if err != nil {
+			msg(fmt.Sprintf("Ignoring invalid glob %s: %v", g, err))
+			continue
+		}
+		compiled = append(compiled, re)
+	}
+
+	return compiled
+}
+
+func matchesAny(globs []string, path string) bool {
+	return matchesRegexps(compileGlobs(globs), path)
+}
+
+func matchesRegexps(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/pebblescape/pebblescape/pkg/table"
+	"github.com/krisrang/cirunner/junit"
+)
+
+// Verdicts of the isolation check on a failed test
+const (
+	isolationFails     = "fails-in-isolation"
+	isolationSplitOnly = "fails-only-in-split"
+	isolationFlaky     = "flaky"
+	isolationUnknown   = "unknown"
+)
+
+// Directory the reports of isolation check runs are copied to
+const isolationDir = "tmp/isolation"
+
+// failedTest is a scenario or spec example that failed in a run of the build
+type failedTest struct {
+	run      string
+	scenario string
+	example  *junit.TestCase
+	verdict  string
+	comment  string
+}
+
+func (t failedTest) String() string {
+	if t.example != nil {
+		return fmt.Sprintf("%s %s", appPath(t.example.File), t.example.Name)
+	}
+
+	return t.scenario
+}
+
+// Split running only t in a run of its own
+func (t failedTest) split(b *Build, run string) Split {
+	if t.example != nil {
+		return Split{
+			run:        run,
+			reportSrc:  "spec/reports",
+			reportDest: filepath.Join(isolationDir, run),
+			cmd:        append(b.rspecCmd(), appPath(t.example.File), "--example", t.example.Name),
+			triage:     true,
+		}
+	}
+
+	return Split{
+		run:        run,
+		reportSrc:  "features/reports",
+		reportDest: filepath.Join(isolationDir, run),
+		cmd:        b.cucumberCmd("defined", []string{t.scenario}),
+		triage:     true,
+	}
+}
+
+// Whether t failed in the run of s
+func (t failedTest) failedIn(s Split) (bool, error) {
+	if t.example == nil {
+		failed, err := s.failedScenarios()
+		return rerunIncludes(failed, t.scenario), err
+	}
+
+	suites, err := junit.ParseDir(s.reportDir())
+	if err != nil {
+		return false, err
+	}
+
+	for _, tc := range junit.Failed(suites) {
+		if tc.File == t.example.File && tc.Name == t.example.Name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Tests that failed in the failed runs of the build, from the rerun files
+// of cucumber runs and the reports of rspec
+func failedTests(results []RunResult, splits map[string]Split) []*failedTest {
+	tests := make([]*failedTest, 0)
+
+	for _, r := range results {
+		s, ok := splits[r.run]
+		if r.status != statusFailed || !ok {
+			continue
+		}
+
+		if s.reportSrc == "spec/reports" {
+			suites, err := junit.ParseDir(s.reportDir())
+			if err != nil {
+				msg(fmt.Sprintf("Reading reports of run %v failed: %v", r.run, err))
+				continue
+			}
+
+			for _, tc := range junit.Failed(suites) {
+				tc := tc
+				tests = append(tests, &failedTest{run: r.run, example: &tc})
+			}
+			continue
+		}
+
+		scenarios, err := s.failedScenarios()
+		if err != nil {
+			msg(fmt.Sprintf("Reading failed scenarios of run %v failed: %v", r.run, err))
+			continue
+		}
+
+		for _, scenario := range scenarios {
+			tests = append(tests, &failedTest{run: r.run, scenario: scenario})
+		}
+	}
+
+	return tests
+}
+
+// Rerun every failed test of the build alone in a clean container. Runs
+// with tests that pass alone are replayed as they were, telling tests that
+// fail only after others of the run from flaky ones.
+func (b *Build) checkIsolation(ctx context.Context, results []RunResult, splits []Split) []*failedTest {
+	runs := make(map[string]Split)
+	for _, s := range splits {
+		runs[s.run] = s
+	}
+
+	tests := failedTests(results, runs)
+	if len(tests) == 0 {
+		msg("No failed tests found in the reports")
+		return tests
+	}
+
+	msg(fmt.Sprintf("Running %d failed test(s) alone", len(tests)))
+
+	isolated := make([]Split, 0, len(tests))
+	for i, t := range tests {
+		isolated = append(isolated, t.split(b, fmt.Sprintf("isolation-%d", i+1)))
+	}
+
+	isolatedResults := runAll(ctx, b, isolated)
+
+	replays := make(map[string]Split)
+	for i, t := range tests {
+		s := isolated[i]
+		r := isolatedResults[s.run]
+
+		switch r.status {
+		case statusPassed:
+			// Decided by the replay of its run
+			replay := runs[t.run]
+			replay.run = t.run + "-replay"
+			replay.reportDest = filepath.Join(isolationDir, replay.run)
+			replay.triage = true
+			replays[t.run] = replay
+			continue
+		case statusFailed:
+		default:
+			t.verdict, t.comment = isolationUnknown, fmt.Sprintf("Running alone %s: %s", r.status, r.comment)
+			continue
+		}
+
+		failed, err := t.failedIn(s)
+		switch {
+		case err != nil:
+			t.verdict, t.comment = isolationUnknown, fmt.Sprintf("Reading reports failed: %v", err)
+		case failed:
+			t.verdict = isolationFails
+		default:
+			t.verdict, t.comment = isolationUnknown, "Run alone failed without failing the test"
+		}
+	}
+
+	if len(replays) > 0 {
+		msg(fmt.Sprintf("Replaying %d run(s) with tests passing alone", len(replays)))
+
+		replaySplits := make([]Split, 0, len(replays))
+		for _, s := range replays {
+			replaySplits = append(replaySplits, s)
+		}
+
+		replayResults := runAll(ctx, b, replaySplits)
+
+		for _, t := range tests {
+			if t.verdict != "" {
+				continue
+			}
+
+			s := replays[t.run]
+			r := replayResults[s.run]
+			if r.status != statusPassed && r.status != statusFailed {
+				t.verdict, t.comment = isolationUnknown, fmt.Sprintf("Replaying run %s: %s", r.status, r.comment)
+				continue
+			}
+
+			failed, err := t.failedIn(s)
+			switch {
+			case err != nil:
+				t.verdict, t.comment = isolationUnknown, fmt.Sprintf("Reading reports failed: %v", err)
+			case failed:
+				t.verdict = isolationSplitOnly
+			default:
+				t.verdict = isolationFlaky
+			}
+		}
+	}
+
+	tbl := table.New(4)
+	tbl.Add("RUN", "TEST", "VERDICT", "")
+	for _, t := range tests {
+		tbl.Add(t.run, t.String(), t.verdict, t.comment)
+	}
+
+	topic("Isolation check")
+	fmt.Print(tbl.String())
+
+	return tests
+}
+
+// Summary of the verdicts on the tests of run, like "1 flaky, 2
+// fails-in-isolation"
+func isolationSummary(tests []*failedTest, run string) string {
+	counts := make(map[string]int)
+	for _, t := range tests {
+		if t.run == run {
+			counts[t.verdict]++
+		}
+	}
+
+	verdicts := make([]string, 0, len(counts))
+	for verdict, n := range counts {
+		verdicts = append(verdicts, fmt.Sprintf("%d %s", n, verdict))
+	}
+	sort.Strings(verdicts)
+
+	return strings.Join(verdicts, ", ")
+}
+
+// Run splits on the hosts of the build as many at a time as they have
+// capacity for, returning their results by run
+func runAll(ctx context.Context, b *Build, splits []Split) map[string]RunResult {
+	queue := NewQueue(splits)
+	results := make(map[string]RunResult)
+	mu := sync.Mutex{}
+
+	wg := sync.WaitGroup{}
+
+	for _, h := range b.hosts {
+		runners := h.capacity
+		if runners > len(splits) {
+			runners = len(splits)
+		}
+
+		wg.Add(runners)
+
+		for i := 0; i < runners; i++ {
+			go func(h *DockerHost) {
+				defer wg.Done()
+
+				for {
+					s, ok := queue.Next()
+					if !ok {
+						return
+					}
+
+					r := runSplit(ctx, b, h, s)
+
+					mu.Lock()
+					results[s.run] = r
+					mu.Unlock()
+
+					queue.Complete(s.run)
+				}
+			}(h)
+		}
+	}
+
+	wg.Wait()
+	return results
+}
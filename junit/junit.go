@@ -0,0 +1,114 @@
+package junit
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type TestSuite struct {
+	Name      string     `xml:"name,attr"`
+	Tests     int        `xml:"tests,attr"`
+	Failures  int        `xml:"failures,attr"`
+	Errors    int        `xml:"errors,attr"`
+	Time      float64    `xml:"time,attr"`
+	TestCases []TestCase `xml:"testcase"`
+}
+
+type TestCase struct {
+	Name      string   `xml:"name,attr"`
+	ClassName string   `xml:"classname,attr"`
+	File      string   `xml:"file,attr"`
+	Time      float64  `xml:"time,attr"`
+	Failure   *Failure `xml:"failure"`
+	Error     *Failure `xml:"error"`
+	Skipped   *Failure `xml:"skipped"`
+}
+
+type Failure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// Failed reports whether the test case failed or errored
+func (tc TestCase) Failed() bool {
+	return tc.Failure != nil || tc.Error != nil
+}
+
+// Parse reads a report with either a testsuites or a single testsuite root
+func Parse(r io.Reader) ([]TestSuite, error) {
+	var root struct {
+		XMLName xml.Name
+		TestSuite
+		Suites []TestSuite `xml:"testsuite"`
+	}
+
+	if err := xml.NewDecoder(r).Decode(&root); err != nil {
+		return nil, err
+	}
+
+	if root.XMLName.Local == "testsuites" {
+		return root.Suites, nil
+	}
+
+	return []TestSuite{root.TestSuite}, nil
+}
+
+// ParseFile reads the report at path
+func ParseFile(path string) ([]TestSuite, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// ParseDir reads all reports in dir and its subdirectories, a missing dir
+// has no reports
+func ParseDir(dir string) ([]TestSuite, error) {
+	suites := make([]TestSuite, 0)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !strings.HasSuffix(path, ".xml") {
+			return nil
+		}
+
+		parsed, err := ParseFile(path)
+		if err != nil {
+			return err
+		}
+
+		suites = append(suites, parsed...)
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		return suites, nil
+	}
+
+	return suites, err
+}
+
+// Failed returns the test cases of suites that failed or errored
+func Failed(suites []TestSuite) []TestCase {
+	failed := make([]TestCase, 0)
+
+	for _, s := range suites {
+		for _, tc := range s.TestCases {
+			if tc.Failed() {
+				failed = append(failed, tc)
+			}
+		}
+	}
+
+	return failed
+}
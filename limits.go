@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Memory a run is assumed to need when no --memory limit is given, enough
+// for Rails and a headless browser
+const defaultRunMemory = 2 << 30
+
+// Memory sizes the way docker takes them, like 512m, 2g, 2gb or 1.5GiB
+var memoryRe = regexp.MustCompile(`^(\d+(?:\.\d+)?) ?([kmgtp])?i?b?$`)
+
+var memoryUnits = map[string]int64{"": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30, "t": 1 << 40, "p": 1 << 50}
+
+// Parse a docker memory size like 512m or 2gb into bytes
+func parseMemory(s string) (int64, error) {
+	m := memoryRe.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, fmt.Errorf("Invalid memory size %q", s)
+	}
+
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid memory size %q", s)
+	}
+
+	return int64(n * float64(memoryUnits[m[2]])), nil
+}
+
+// Memory available to containers, the lower of what the host has available
+// and the cgroup limit of cirunner. Returns 0 when unknown.
+func availableMemory() int64 {
+	available := int64(0)
+
+	if f, err := os.Open("/proc/meminfo"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+				kb, _ := strconv.ParseInt(fields[1], 10, 64)
+				available = kb << 10
+			}
+		}
+		f.Close()
+	}
+
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		limit, err := readInt(path)
+		if err == nil && limit > 0 && (available == 0 || limit < available) {
+			available = limit
+		}
+	}
+
+	return available
+}
+
+// CPUs available to containers, taking a cgroup CPU quota into account
+func availableCPUs() float64 {
+	cpus := float64(runtime.NumCPU())
+
+	// cgroup v2 has "quota period" in cpu.max, v1 separate files
+	quota, period := int64(0), int64(0)
+	if b, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) == 2 {
+			quota, _ = strconv.ParseInt(fields[0], 10, 64)
+			period, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	} else {
+		quota, _ = readInt("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+		period, _ = readInt("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	}
+
+	if quota > 0 && period > 0 {
+		cpus = math.Min(cpus, float64(quota)/float64(period))
+	}
+
+	return cpus
+}
+
+func readInt(path string) (int64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// Number of feature runs the local host fits given the CPUs and memory of
+// each run, leaving room for the rspec run alongside them
+func defaultRuns(cpus float64, memory int64) int {
+	return fitRuns(availableCPUs(), availableMemory(), cpus, memory)
+}
+
+// Number of runs a remote docker host fits, going by the CPUs and memory
+// docker reports for it
+func (h *DockerHost) defaultRuns(cpus float64, memory int64) (int, error) {
+	err, stdout, stderr := h.docker(veryverbose, "info", "--format", "{{.NCPU}} {{.MemTotal}}")
+	if err != nil {
+		return 0, fmt.Errorf("Getting resources of docker host %v failed: %v\n%s", h, err, stderr.String())
+	}
+
+	var hostCPUs float64
+	var hostMemory int64
+	if _, err := fmt.Sscan(stdout.String(), &hostCPUs, &hostMemory); err != nil {
+		return 0, fmt.Errorf("Reading resources of docker host %v failed: %v", h, err)
+	}
+
+	return fitRuns(hostCPUs, hostMemory, cpus, memory), nil
+}
+
+// Number of runs fitting available CPUs and memory, less one for the rspec
+// run. Memory is ignored when unknown.
+func fitRuns(availableCPUs float64, available int64, cpus float64, memory int64) int {
+	runs := int(availableCPUs) - 1
+	if cpus > 0 {
+		runs = int(availableCPUs/cpus) - 1
+	}
+
+	if memory == 0 {
+		memory = defaultRunMemory
+	}
+
+	if available > 0 {
+		if memRuns := int(available/memory) - 1; memRuns < runs {
+			runs = memRuns
+		}
+	}
+
+	if runs < 1 {
+		runs = 1
+	}
+
+	return runs
+}
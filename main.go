@@ -1,47 +1,58 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
-	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/codegangsta/cli"
-	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/pebblescape/pebblescape/pkg/random"
 	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/pebblescape/pebblescape/pkg/table"
 	"github.com/krisrang/cirunner/cucumber"
+	"github.com/krisrang/cirunner/rspec"
 )
 
 var (
 	verbose     = false
 	veryverbose = false
 	commit      = false
+	output      *OutputMux
+	dashboard   *Dashboard
+	console     io.Writer = os.Stdout
 )
 
 type Split struct {
-	features []cucumber.FeatureFile
-	run      string
+	features   []cucumber.FeatureFile
+	specs      []rspec.SpecFile
+	run        string
+	reportSrc  string
+	reportDest string
+	suite      string
+	cmd        []string
+
+	// Rerun of tests of the build to triage failures, like the isolation
+	// check, whose coverage and artifacts aren't collected
+	triage bool
 }
 
 type RunResult struct {
-	success  bool
-	run      string
-	comment  string
-	duration time.Duration
-	stdout   bytes.Buffer
-	stderr   bytes.Buffer
+	status    Status
+	run       string
+	comment   string
+	duration  time.Duration
+	stdout    bytes.Buffer
+	stderr    bytes.Buffer
+	artifacts []string
 }
 
 type RunResults struct {
@@ -49,21 +60,33 @@ type RunResults struct {
 	results []RunResult
 }
 
-func (a RunResults) Len() int           { return len(a.results) }
-func (a RunResults) Swap(i, j int)      { a.results[i], a.results[j] = a.results[j], a.results[i] }
-func (a RunResults) Less(i, j int) bool { return a.results[i].run < a.results[j].run }
+func (a *RunResults) Len() int           { return len(a.results) }
+func (a *RunResults) Swap(i, j int)      { a.results[i], a.results[j] = a.results[j], a.results[i] }
+func (a *RunResults) Less(i, j int) bool { return a.results[i].run < a.results[j].run }
 
 func main() {
 	app := cli.NewApp()
 	app.Name = "cirunner"
 	app.Version = "0.2.3"
 	app.Action = run
+	app.Commands = []cli.Command{
+		planCommand,
+		workerCommand,
+		cleanCommand,
+		debugCommand,
+		bisectCommand,
+	}
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "path",
 			Value: "./",
 			Usage: "path to execute build in",
 		},
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "config file relative to path, defaults to " + defaultConfig + " if there is one",
+		},
 		cli.StringFlag{
 			Name:   "name",
 			Value:  "",
@@ -81,6 +104,17 @@ func main() {
 			Usage:  "cucumber tags to filter features on",
 			EnvVar: "CUCUMBER_TAGS",
 		},
+		cli.StringFlag{
+			Name:   "data-dir",
+			Value:  "",
+			EnvVar: "CIRUNNER_DATA_DIR",
+			Usage:  "directory to keep data across builds in, defaults to ~/.cirunner",
+		},
+		cli.StringFlag{
+			Name:  "changed-since",
+			Value: "",
+			Usage: "only run features and specs affected by changes since this git ref, like origin/master",
+		},
 		cli.StringSliceFlag{
 			Name:   "slowtags",
 			Usage:  "cucumber tags to assign more step weight to",
@@ -94,67 +128,220 @@ func main() {
 			Name:  "veryverbose, vvv",
 			Usage: "very verbose logging",
 		},
+		cli.BoolFlag{
+			Name:  "color",
+			Usage: "colorize run prefixes of verbose output",
+		},
+		cli.BoolFlag{
+			Name:  "timestamps",
+			Usage: "timestamp lines of verbose output",
+		},
+		cli.BoolFlag{
+			Name:  "nodashboard",
+			Usage: "don't show the live dashboard when running in a terminal",
+		},
+		cli.DurationFlag{
+			Name:  "sweep",
+			Value: 24 * time.Hour,
+			Usage: "remove resources of any build started longer ago than this and old images before building, 0 disables",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: 0,
+			Usage: "time after which a run is stopped and reported as timed out, 0 disables",
+		},
+		cli.DurationFlag{
+			Name:  "grace",
+			Value: 10 * time.Second,
+			Usage: "time to give containers to stop when the build is aborted",
+		},
 		cli.BoolFlag{
 			Name:  "commit",
 			Usage: "commit run on failure",
 		},
+		cli.BoolFlag{
+			Name:  "isolation-check",
+			Usage: "rerun every failed test alone after the build, telling whether it fails in isolation, only in its run or is flaky",
+		},
+		cli.StringFlag{
+			Name:  "image",
+			Value: "",
+			Usage: "pre-built image to run the build with instead of building one, like registry/app:sha",
+		},
+		cli.StringFlag{
+			Name:   "registry",
+			Value:  "",
+			EnvVar: "CIRUNNER_REGISTRY",
+			Usage:  "registry to pull the pre-built image from when a host doesn't have it",
+		},
+		cli.StringFlag{
+			Name:  "dockerfile",
+			Value: "Dockerfile",
+			Usage: "path of the Dockerfile to build the image from, relative to path",
+		},
+		cli.StringFlag{
+			Name:  "target",
+			Value: "",
+			Usage: "stage of a multi-stage Dockerfile to build",
+		},
+		cli.StringSliceFlag{
+			Name:  "build-arg",
+			Value: &cli.StringSlice{},
+			Usage: "build argument like KEY=value, a bare KEY takes the value from the environment",
+		},
+		cli.StringSliceFlag{
+			Name:  "image-tag",
+			Value: &cli.StringSlice{},
+			Usage: "extra tag to give the built image",
+		},
+		cli.BoolFlag{
+			Name:  "pull",
+			Usage: "always pull newer versions of base images, rebuilding the image",
+		},
+		cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "build the image without docker's layer cache",
+		},
+		cli.IntFlag{
+			Name:   "node-index",
+			Value:  0,
+			EnvVar: "CI_NODE_INDEX",
+			Usage:  "index of this node when sharding the build across nodes, starting from 0",
+		},
+		cli.IntFlag{
+			Name:   "node-total",
+			Value:  1,
+			EnvVar: "CI_NODE_TOTAL",
+			Usage:  "number of nodes to shard the build across",
+		},
 		cli.IntFlag{
 			Name:  "maxruns",
 			Value: 0,
-			Usage: "maximum concurrent builds to run, defaults to number of CPUs",
+			Usage: "maximum concurrent builds to run, defaults to as many as the CPUs and memory of the host fit",
+		},
+		cli.StringFlag{
+			Name:  "cpus",
+			Value: "",
+			Usage: "number of CPUs each run may use, like 1.5",
+		},
+		cli.StringFlag{
+			Name:  "memory",
+			Value: "",
+			Usage: "memory each run may use, like 2g",
+		},
+		cli.IntFlag{
+			Name:   "seed",
+			Value:  0,
+			EnvVar: "CIRUNNER_SEED",
+			Usage:  "seed for the order of features and specs, defaults to a random one. Rerun with the seed of a build to replay it.",
+		},
+		cli.IntFlag{
+			Name:  "splits",
+			Value: 0,
+			Usage: "number of runs to split features into, defaults to maxruns",
+		},
+		cli.StringSliceFlag{
+			Name:   "docker-host",
+			Value:  &cli.StringSlice{},
+			EnvVar: "CIRUNNER_DOCKER_HOSTS",
+			Usage:  "docker host to schedule runs on, like tcp://10.0.0.2:2376=4 to run up to 4 at a time, defaults to maxruns",
+		},
+		cli.StringFlag{
+			Name:  "coordinator",
+			Value: "",
+			Usage: "address to serve splits to remote workers on, like :8080",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			Value:  "",
+			EnvVar: "CIRUNNER_TOKEN",
+			Usage:  "token workers have to present to the coordinator",
+		},
+		cli.DurationFlag{
+			Name:  "lease-ttl",
+			Value: 2 * time.Minute,
+			Usage: "time after which splits of unresponsive workers are requeued",
 		},
 	}
 	app.Run(os.Args)
 }
 
 func run(c *cli.Context) {
-	path, _ := filepath.Abs(c.GlobalString("path"))
-	buildname := c.GlobalString("name")
-	buildid := c.GlobalString("id")
-	tagArgs := c.GlobalStringSlice("tags")
-	slowTags := c.GlobalStringSlice("slowtags")
-	runs := c.GlobalInt("maxruns")
 	verbose = c.GlobalBool("verbose")
 	veryverbose = c.GlobalBool("veryverbose")
 	commit = c.GlobalBool("commit")
+	output = NewOutputMux(os.Stdout, c.GlobalBool("color"), c.GlobalBool("timestamps"))
 
-	if buildname == "" {
-		log.Fatal("Must specify build name")
+	// Verbose output doesn't mix with the dashboard, so it's only shown when
+	// nothing else is writing to the terminal
+	if isTerminal() && !verbose && !veryverbose && !c.GlobalBool("nodashboard") {
+		dashboard = NewDashboard(os.Stdout)
 	}
 
-	buildname = strings.ToLower(buildname)
-
-	if buildid == "" {
-		buildid = random.Hex(4)
+	b, err := newBuild(c)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if runs == 0 {
-		runs = runtime.NumCPU()
+	// Heartbeats are sent and leases checked a few times per TTL
+	if c.GlobalString("coordinator") != "" && c.GlobalDuration("lease-ttl") < minLeaseTTL {
+		log.Fatal(fmt.Errorf("Lease TTL must be at least %v", minLeaseTTL))
 	}
 
-	topic(fmt.Sprintf("Starting build %s of %s", buildid, buildname))
+	topic(fmt.Sprintf("Starting build %s of %s", b.id, b.name))
 
-	msg(fmt.Sprintf("Changing working directory to %s", path))
-	if err := os.Chdir(path); err != nil {
+	if err := b.prepare(); err != nil {
 		log.Fatal(err)
 	}
 
-	topic("Preparing config files and cleaning old reports")
-	os.Rename("config/database.ci.yml", "config/database.yml")
-	os.Rename("config/redis.ci.yml", "config/redis.yml")
-	os.RemoveAll("spec/reports")
-	os.RemoveAll("features/reports")
+	if sweep := c.GlobalDuration("sweep"); sweep > 0 {
+		topic(fmt.Sprintf("Removing resources of builds older than %v", sweep))
+		err := eachHost(b.hosts, func(h *DockerHost) error {
+			if err := removeOldImages(h, "", keptImages); err != nil {
+				return err
+			}
+			return removeResources(h, "", "", sweep)
+		})
+		if err != nil {
+			msg(err.Error())
+		}
+	}
+
+	if b.sharded() {
+		msg(fmt.Sprintf("Running node %d of %d", b.nodeIndex, b.nodeTotal))
+	}
 
-	topic("Building base image")
-	if err, _, _ := runCmd(veryverbose, "docker", "build", "-t", buildname, "."); err != nil {
-		log.Fatal(err)
+	msg(fmt.Sprintf("Using seed %d", b.seed))
+
+	if len(b.hosts) > 1 {
+		for _, h := range b.hosts {
+			msg(fmt.Sprintf("Docker host %v, up to %d runs", h, h.capacity))
+		}
+	}
+
+	// Failing to get the build going is an infrastructure error, not a
+	// failed build
+	if err := b.ensureImage(); err != nil {
+		log.Println(err)
+		os.Exit(b.cleanup(exitInfra))
+	}
+
+	if err := b.createCaches(); err != nil {
+		log.Println(err)
+		os.Exit(b.cleanup(exitInfra))
 	}
 
 	topic("Selecting features")
-	tags := cucumber.ParseTags(tagArgs, slowTags)
-	features, err := cucumber.Select(tags)
+	features, err := b.selectFeatures()
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		os.Exit(b.cleanup(exitInfra))
+	}
+
+	specs, err := b.selectSpecs()
+	if err != nil {
+		log.Println(err)
+		os.Exit(b.cleanup(exitInfra))
 	}
 
 	if verbose {
@@ -164,263 +351,510 @@ func run(c *cli.Context) {
 			filesTbl.Add(f.Path, strconv.Itoa(f.Weight))
 		}
 
+		for _, s := range specs {
+			filesTbl.Add(s.Path, strconv.Itoa(s.Weight))
+		}
+
 		fmt.Print(filesTbl.String())
 	}
 
-	splits := splitFeatures(runs, features)
-	runs = len(splits)
-
-	topic("Starting database")
-	dbcnt := fmt.Sprintf("%s-%s-db", buildname, buildid)
-	runCmd(veryverbose, "docker", "rm", "-f", "-v", dbcnt)
-	if err, stdout, stderr := runCmd(veryverbose, "docker", "run", "-d", "--name", dbcnt, "-e", "MYSQL_ROOT_PASSWORD=jenkins", "mariadb:latest"); err != nil {
-		log.Fatal(fmt.Errorf("Starting DB failed: %v\n%s\n%s", err, stdout, stderr))
+	splits := b.splits(features, specs)
+	if len(splits) == 0 {
+		msg("No features or specs to run")
 	}
 
-	// Wait for DB to boot
-	time.Sleep(10 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(b, cancel)
 
-	// Cleanup all containers on interrupt
-	go func() {
-		sigchan := make(chan os.Signal, 10)
-		signal.Notify(sigchan, os.Interrupt)
-		<-sigchan
-		log.Println("CI runner killed !")
-
-		cmd := []string{
-			"rm",
-			"-f",
-			"-v",
-			dbcnt,
-		}
-
-		for _, s := range splits {
-			cmd = append(cmd, fmt.Sprintf("%s-%s-%s", buildname, buildid, s.run))
-			cmd = append(cmd, fmt.Sprintf("%s-%s-%s-redis", buildname, buildid, s.run))
-		}
-
-		cmd = append(cmd, fmt.Sprintf("%s-%s-%s", buildname, buildid, "rspec"))
-		cmd = append(cmd, fmt.Sprintf("%s-%s-%s-redis", buildname, buildid, "rspec"))
+	topic("Starting database")
+	if err := b.startDB(); err != nil {
+		log.Println(err)
+		os.Exit(b.cleanup(exitInfra))
+	}
 
-		runCmd(veryverbose, "docker", cmd...)
+	if err := b.runPrepare(ctx); err != nil {
+		log.Println(err)
+		os.Exit(b.cleanup(setupFailed(ctx)))
+	}
 
-		os.Exit(1)
-	}()
+	if ctx.Err() != nil {
+		os.Exit(b.cleanup(exitAborted))
+	}
 
 	// Run build
-	topic(fmt.Sprintf("Running build in %v runs + rspec run", runs))
+	topic(fmt.Sprintf("Running build in %v runs", len(splits)))
 	results := &RunResults{
 		results: make([]RunResult, 0),
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(runs + 1)
+	for _, s := range splits {
+		dashboard.Add(s.run, s.weight())
+	}
 
-	// Run specs
-	rspecSplit := Split{
-		run: "rspec",
+	if dashboard != nil {
+		dashboard.Start()
+		console = dashboard
 	}
-	cmd := []string{
-		"bundle", "exec", "rspec",
-		"--format", "progress",
-		"--format", "RspecJunitFormatter",
-		"--out", "spec/reports/rspec.xml",
-		"--color", "--no-drb",
+
+	queue := NewQueue(splits)
+
+	var co *Coordinator
+	if addr := c.GlobalString("coordinator"); addr != "" {
+		msg(fmt.Sprintf("Serving splits to workers on %s", addr))
+		co = NewCoordinator(ctx, b, queue, results, splits, c.GlobalString("token"), c.GlobalDuration("lease-ttl"))
+
+		go func() {
+			if err := co.Listen(addr); err != nil {
+				msg(fmt.Sprintf("Coordinator failed: %v", err))
+			}
+		}()
 	}
-	go processRun(&wg, results, rspecSplit, buildname, buildid, "spec/reports", "spec", dbcnt, cmd...)
 
-	// Run features
-	for _, s := range splits {
-		// Shuffle features
-		for i := range s.features {
-			j := rand.Intn(i + 1)
-			s.features[i], s.features[j] = s.features[j], s.features[i]
-		}
+	// Every host runs as many splits as it has capacity for, taking the
+	// next one off the queue as soon as one finishes
+	wg := sync.WaitGroup{}
 
-		cmd := []string{
-			"bundle", "exec", "cucumber",
-			"-r", "features",
-			"--format", "progress",
-			"--format", "junit",
-			"--out", "features/reports",
-			"--color", "--no-drb",
+	for _, h := range b.hosts {
+		runners := h.capacity
+		if runners > len(splits) {
+			runners = len(splits)
 		}
 
-		for _, t := range tagArgs {
-			cmd = append(cmd, "--tags", t)
-		}
+		wg.Add(runners)
 
-		for _, f := range s.features {
-			cmd = append(cmd, f.Path)
-		}
+		for i := 0; i < runners; i++ {
+			go func(h *DockerHost) {
+				defer wg.Done()
+
+				for {
+					s, ok := queue.Next()
+					if !ok {
+						return
+					}
 
-		go processRun(&wg, results, s, buildname, buildid, "features/reports", "features/reports/"+s.run, dbcnt, cmd...)
+					registerResult(results, runSplit(ctx, b, h, s))
+					queue.Complete(s.run)
+				}
+			}(h)
+		}
 	}
 
 	// Wait for runs to finish
 	wg.Wait()
 
+	dashboard.Stop()
+	console = os.Stdout
+
+	// Triage data on the failed tests, it doesn't change the result of the
+	// build
+	var isolation []*failedTest
+	if c.GlobalBool("isolation-check") && ctx.Err() == nil && results.anyFailed() {
+		topic("Checking failed tests in isolation")
+		isolation = b.checkIsolation(ctx, results.results, splits)
+	}
+
 	// Results
-	sort.Sort(RunResults(*results))
-	success := true
+	sort.Sort(results)
 	resultTbl := table.New(4)
-	resultTbl.Add("RUN", "SUCCESS", "DURATION", "")
+	resultTbl.Add("RUN", "STATUS", "DURATION", "")
+
+	runs := make(map[string]Split)
+	for _, s := range splits {
+		runs[s.run] = s
+	}
 
 	for _, r := range results.results {
-		if !r.success {
-			success = false
+		comment := r.comment
+		if !b.blocking(runs[r.run]) {
+			comment = strings.TrimSpace(comment + " (non-blocking)")
+		}
+		if summary := isolationSummary(isolation, r.run); summary != "" {
+			comment = strings.TrimSpace(comment + " (" + summary + ")")
 		}
 
-		resultTbl.Add(r.run, strconv.FormatBool(r.success), formatDuration(r.duration), r.comment)
+		resultTbl.Add(r.run, r.status.String(), formatDuration(r.duration), comment)
 	}
 
 	topic("Results")
 	fmt.Print(resultTbl.String())
+	msg(fmt.Sprintf("Seed %d, replay with --seed %d", b.seed, b.seed))
+
+	if co != nil {
+		co.Drain()
+	}
+
+	if ctx.Err() != nil {
+		os.Exit(b.cleanup(exitAborted))
+	}
+
+	if b.config.Coverage != nil {
+		topic("Merging coverage")
+		if err := b.mergeCoverage(); err != nil {
+			msg(fmt.Sprintf("Merging coverage failed: %v", err))
+		}
+	}
 
-	if !success {
-		os.Exit(cleanup(dbcnt, 1))
+	// Partial builds would drop the coverage of tests that didn't run
+	if cov := b.config.Coverage; cov != nil && cov.Map && b.changedSince == "" {
+		if err := b.updateCoverageMap(); err != nil {
+			msg(fmt.Sprintf("Updating coverage map failed: %v", err))
+		}
 	}
-	os.Exit(cleanup(dbcnt, 0))
+
+	code, reason := b.config.Policy.exitCode(b, results.results, splits)
+	if code != exitPassed {
+		msg(fmt.Sprintf("Build %s", reason))
+	}
+	os.Exit(b.cleanup(code))
 }
 
-func cleanup(dbcnt string, code int) int {
-	defer runCmd(veryverbose, "docker", "rm", "-f", "-v", dbcnt)
+// First signal cancels ctx, letting runs stop their containers and copy
+// partial reports. A second one removes everything right away.
+func handleSignals(b *Build, cancel context.CancelFunc) {
+	sigchan := make(chan os.Signal, 10)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	return code
+	go func() {
+		sig := <-sigchan
+		log.Printf("CI runner received %v, stopping runs", sig)
+		cancel()
+
+		sig = <-sigchan
+		log.Printf("CI runner received %v again, killing runs", sig)
+
+		os.Exit(b.cleanup(exitAborted))
+	}()
 }
 
-func splitFeatures(runs int, feat []cucumber.FeatureFile) map[int]Split {
-	result := make(map[int]Split, 0)
+// Exit code of a build whose setup failed, which is aborted rather than
+// broken when ctx was cancelled
+func setupFailed(ctx context.Context) int {
+	if ctx.Err() != nil {
+		return exitAborted
+	}
 
-	for i, f := range feat {
-		id := (i + 1) % runs
-		if id == 0 {
-			id = runs
-		}
+	return exitInfra
+}
 
-		res, ok := result[id]
-		if !ok {
-			res = Split{
-				features: make([]cucumber.FeatureFile, 0),
-				run:      strconv.Itoa(id),
-			}
-		}
+// Remove everything the build created, returning code for convenience
+func (b *Build) cleanup(code int) int {
+	eachHost(b.hosts, func(h *DockerHost) error {
+		h.resources.Teardown()
+		return nil
+	})
 
-		res.features = append(res.features, f)
-		result[id] = res
+	return code
+}
+
+// Run split on host h, retrying it once when it fails for reasons of
+// infrastructure rather than the tests
+func runSplit(ctx context.Context, b *Build, h *DockerHost, s Split) RunResult {
+	r := processRun(ctx, b, h, s)
+	if r.status != statusInfra || ctx.Err() != nil {
+		return r
 	}
 
-	return result
+	msg(fmt.Sprintf("Run %v hit an infrastructure error, retrying: %v", s.run, r.comment))
+	dashboard.SetPhase(s.run, phaseQueued)
+
+	retry := processRun(ctx, b, h, s)
+	if retry.status == statusInfra {
+		retry.comment += " (retried)"
+	}
+
+	return retry
 }
 
-func processRun(wg *sync.WaitGroup, results *RunResults, s Split, buildname, buildid, reportSrc, reportDest, dbcnt string, cmd ...string) {
+func processRun(ctx context.Context, b *Build, h *DockerHost, s Split) RunResult {
 	start := time.Now()
-	runcnt := fmt.Sprintf("%s-%s-%s", buildname, buildid, s.run)
-	dbname := strings.Replace(fmt.Sprintf("%s_%s_%s_test", buildname, buildid, s.run), "-", "_", -1)
-	rediscnt := fmt.Sprintf("%s-redis", runcnt)
+	runcnt := b.container(s.run)
+	rediscnt := b.redisContainer(s.run)
+
+	// The run is stopped like an aborted build when it exceeds the timeout
+	runCtx, cancel := ctx, context.CancelFunc(func() {})
+	if b.timeout > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, b.timeout)
+	}
+	defer cancel()
+
+	// Verbose output of the run goes through the multiplexer so concurrent
+	// runs don't interleave mid-line
+	stdout, stderr := output.Writer(s.run), output.Writer(s.run)
+	writers := func(pipe bool) (io.Writer, io.Writer) {
+		if pipe {
+			return stdout, stderr
+		}
+		return nil, nil
+	}
+	docker := func(pipe bool, args ...string) (error, bytes.Buffer, bytes.Buffer) {
+		out, errw := writers(pipe)
+		return h.dockerTo(out, errw, args...)
+	}
 
 	defer func() {
-		runCmd(veryverbose, "docker", "rm", "-f", "-v", runcnt, rediscnt)
-		wg.Done()
+		h.resources.Release(kindContainer, runcnt, b.migrateContainer(s.run), rediscnt)
+		stdout.Flush()
+		stderr.Flush()
 	}()
 
-	runCmd(veryverbose, "docker", "rm", "-f", "-v", runcnt, rediscnt)
+	docker(veryverbose, "rm", "-f", "-v", runcnt, b.migrateContainer(s.run), rediscnt)
+
+	// Result of a run stopped by an aborted build or the timeout, nil if it
+	// wasn't stopped
+	stopped := func(outBuf, errBuf bytes.Buffer) *RunResult {
+		var r RunResult
+
+		switch {
+		case ctx.Err() != nil:
+			r = newResult(statusCancelled, s.run, "Aborted", start, outBuf, errBuf)
+		case runCtx.Err() != nil:
+			msg(fmt.Sprintf("Run %v timed out after %v", s.run, b.timeout))
+			r = newResult(statusTimeout, s.run, fmt.Sprintf("Timed out after %v", b.timeout), start, outBuf, errBuf)
+		default:
+			return nil
+		}
+
+		return &r
+	}
 
 	// Spin up redis
-	if err, stdout, stderr := runCmd(veryverbose, "docker", "run", "-d", "--name", rediscnt, "redis"); err != nil {
-		setResult(results, true, s.run, fmt.Sprintf("Starting redis failed: %v", err), start, stdout, stderr)
-		return
+	if r := stopped(bytes.Buffer{}, bytes.Buffer{}); r != nil {
+		return *r
+	}
+
+	dashboard.SetPhase(s.run, phaseRedis)
+	h.resources.Track(kindContainer, rediscnt)
+	if err, stdout, stderr := docker(veryverbose, b.redisArgs(s.run)...); err != nil {
+		return newResult(statusInfra, s.run, fmt.Sprintf("Starting redis failed: %v", err), start, stdout, stderr)
 	}
 
 	// Load up database schema and migrate
-	if err, stdout, stderr := runCmd(verbose, "docker", "run", "--rm",
-		"-e", "RAILS_ENV=test",
-		"-e", "DBNAME="+dbname,
-		"--link", dbcnt+":db", "--link", rediscnt+":redis",
-		buildname,
-		"bundle", "exec", "rake", "db:create", "db:schema:load", "db:migrate"); err != nil {
-		setResult(results, false, s.run, fmt.Sprintf("Migrating DB failed: %v", err), start, stdout, stderr)
-		return
-	}
-
-	baseCmd := []string{
-		"run",
-		"--name",
-		runcnt,
-		"-e",
-		"RAILS_ENV=test",
-		"-e",
-		"DBNAME=" + dbname,
-		"--link",
-		dbcnt + ":db",
-		"--link",
-		rediscnt + ":redis",
-		buildname,
+	if r := stopped(bytes.Buffer{}, bytes.Buffer{}); r != nil {
+		return *r
+	}
+	dashboard.SetPhase(s.run, phaseMigrating)
+	h.resources.Track(kindContainer, b.migrateContainer(s.run))
+	stopWait := stopOnCancel(runCtx, h, b.grace, b.migrateContainer(s.run))
+	err, outBuf, errBuf := docker(verbose, b.migrateArgs(h, s.run)...)
+	stopWait()
+	h.resources.Forget(kindContainer, b.migrateContainer(s.run))
+	if r := stopped(outBuf, errBuf); r != nil {
+		return *r
+	}
+	// Mostly the database not accepting connections yet, so retried like
+	// other infrastructure errors
+	if err != nil {
+		return newResult(statusInfra, s.run, fmt.Sprintf("Migrating DB failed: %v", err), start, outBuf, errBuf)
 	}
 
 	// TESTS! (=^ェ^=)
-	err, stdout, stderr := runCmd(verbose, "docker", append(baseCmd, cmd...)...)
+	if r := stopped(bytes.Buffer{}, bytes.Buffer{}); r != nil {
+		return *r
+	}
+	dashboard.SetPhase(s.run, phaseRunning)
+	out, errw := writers(verbose)
+	h.resources.Track(kindContainer, runcnt)
+	stopWait = stopOnCancel(runCtx, h, b.grace, runcnt)
+	err, outBuf, errBuf = h.dockerTo(multiWriter(out, dashboard.Progress(s.run)), errw, append(b.runArgs(h, s.run), s.cmd...)...)
+	stopWait()
 
 	// Copy reports from container
-	os.MkdirAll(reportDest, 0777)
-	runCmd(veryverbose, "docker", "cp", runcnt+":/app/"+reportSrc, reportDest)
+	dashboard.SetPhase(s.run, phaseReports)
+	os.MkdirAll(s.reportDest, 0777)
+	docker(veryverbose, "cp", runcnt+":/app/"+s.reportSrc, s.reportDest)
+
+	if cov := b.config.Coverage; cov != nil && !s.triage {
+		os.MkdirAll(b.coverageDir(s.run), 0777)
+		docker(veryverbose, "cp", runcnt+":/app/"+cov.Path, b.coverageDir(s.run))
+	}
+
+	var artifacts []string
+	if b.wantsArtifacts(err != nil) && !s.triage {
+		artifacts = b.collectArtifacts(h, runcnt, s.run)
+	}
+	finish := func(r RunResult) RunResult {
+		r.artifacts = artifacts
+		return r
+	}
+
+	// Stopped, the reports are copied but the run isn't worth committing
+	if r := stopped(outBuf, errBuf); r != nil {
+		if r.status == statusCancelled {
+			msg(fmt.Sprintf("Run %v aborted", s.run))
+		}
+		return finish(*r)
+	}
+
+	// Killed for exceeding its memory limit, or the host running out
+	if err != nil && b.oomKilled(h, runcnt) {
+		msg(fmt.Sprintf("Run %v ran out of memory", s.run))
+		return finish(newResult(statusInfra, s.run, "Out of memory", start, outBuf, errBuf))
+	}
+
+	// Docker failed to run the tests at all
+	if dockerFailed(err) {
+		msg(fmt.Sprintf("Run %v could not be started", s.run))
+		return finish(newResult(statusInfra, s.run, fmt.Sprintf("Starting run failed: %v", err), start, outBuf, errBuf))
+	}
 
 	// Failed, commit the evidence!
 	if err != nil {
 		if commit {
-			msg(fmt.Sprintf("Run %v failed, commiting as %v", s.run, runcnt))
+			msg(fmt.Sprintf("Run %v failed, commiting as %v on %v", s.run, runcnt, h))
 
-			runCmd(veryverbose, "docker", "commit", runcnt, runcnt)
+			docker(veryverbose, "commit",
+				"--change", fmt.Sprintf("LABEL %s=%s %s=%s %s=%d", labelBuild, b.name, labelID, b.id, labelStarted, b.started.Unix()),
+				runcnt, runcnt)
 		} else {
 			msg(fmt.Sprintf("Run %v failed", s.run))
 		}
-		setResult(results, false, s.run, "Run failed", start, stdout, stderr)
-		return
+		return finish(newResult(statusFailed, s.run, "Run failed", start, outBuf, errBuf))
 	}
 
 	msg(fmt.Sprintf("Run %v succeded", s.run))
-	setResult(results, true, s.run, "", start, stdout, stderr)
+	return finish(newResult(statusPassed, s.run, "", start, outBuf, errBuf))
 }
 
-// Register run result
-func setResult(results *RunResults, success bool, run, comment string, start time.Time, stdout, stderr bytes.Buffer) {
-	duration := time.Since(start)
+// Stop container once ctx is cancelled, until the returned func is called.
+// Stopping is retried as the container may not have been created yet when
+// ctx got cancelled.
+func stopOnCancel(ctx context.Context, h *DockerHost, grace time.Duration, container string) func() {
+	finished := make(chan struct{})
 
-	if !success {
-		fail(run, stdout, stderr)
-	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-finished:
+			return
+		}
 
-	results.Lock()
-	defer results.Unlock()
+		for {
+			h.docker(veryverbose, "stop", "-t", strconv.Itoa(int(grace.Seconds())), container)
+
+			select {
+			case <-finished:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+
+	return func() { close(finished) }
+}
 
-	results.results = append(results.results, RunResult{
-		success:  success,
+// Result of a run started at start
+func newResult(status Status, run, comment string, start time.Time, stdout, stderr bytes.Buffer) RunResult {
+	return RunResult{
+		status:   status,
 		run:      run,
 		comment:  comment,
-		duration: duration,
+		duration: time.Since(start),
 		stdout:   stdout,
 		stderr:   stderr,
-	})
+	}
+}
+
+// Register a finished run, a run requeued from a remote worker may finish
+// twice in which case the first result counts
+func registerResult(results *RunResults, r RunResult) {
+	results.Lock()
+	defer results.Unlock()
+
+	for _, existing := range results.results {
+		if existing.run == r.run {
+			return
+		}
+	}
+
+	if r.status == statusPassed {
+		dashboard.SetPhase(r.run, phasePassed)
+	} else {
+		dashboard.SetPhase(r.run, phaseFailed)
+		fail(r)
+	}
+
+	results.results = append(results.results, r)
+}
+
+// Whether any run failed its tests
+func (a *RunResults) anyFailed() bool {
+	a.RLock()
+	defer a.RUnlock()
+
+	for _, r := range a.results {
+		if r.status == statusFailed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Remove and return the result of run
+func (a *RunResults) take(run string) (RunResult, bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	for i, r := range a.results {
+		if r.run == run {
+			a.results = append(a.results[:i], a.results[i+1:]...)
+			return r, true
+		}
+	}
+
+	return RunResult{}, false
 }
 
 func runCmd(pipe bool, name string, args ...string) (error, bytes.Buffer, bytes.Buffer) {
+	if pipe {
+		return runCmdTo(os.Stdout, os.Stderr, name, args...)
+	}
+
+	return runCmdTo(nil, nil, name, args...)
+}
+
+// Run command capturing its output, and also copying it to stdout and stderr
+// when they're not nil
+func runCmdTo(stdout, stderr io.Writer, name string, args ...string) (error, bytes.Buffer, bytes.Buffer) {
 	var outBuf bytes.Buffer
 	var errBuf bytes.Buffer
 
 	cmd := exec.Command(name, args...)
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
 
-	if pipe {
-		fmt.Printf("Running %v %v\n", name, args)
-		cmd.Stdout = io.MultiWriter(bufio.NewWriter(&outBuf), os.Stdout)
-		cmd.Stderr = io.MultiWriter(bufio.NewWriter(&errBuf), os.Stderr)
-	} else {
-		cmd.Stdout = bufio.NewWriter(&outBuf)
-		cmd.Stderr = bufio.NewWriter(&errBuf)
+	if stdout != nil {
+		fmt.Fprintf(stdout, "Running %v %v\n", name, args)
+		cmd.Stdout = io.MultiWriter(&outBuf, stdout)
+	}
+	if stderr != nil {
+		cmd.Stderr = io.MultiWriter(&errBuf, stderr)
 	}
 
 	return cmd.Run(), outBuf, errBuf
 }
 
+// Combine writers ignoring nil ones, returns nil if there's nothing to write to
+func multiWriter(writers ...io.Writer) io.Writer {
+	w := make([]io.Writer, 0)
+
+	for _, writer := range writers {
+		if writer != nil {
+			w = append(w, writer)
+		}
+	}
+
+	switch len(w) {
+	case 0:
+		return nil
+	case 1:
+		return w[0]
+	}
+
+	return io.MultiWriter(w...)
+}
+
 func fmtOut(out []byte) {
 	output := string(out)
 
@@ -429,12 +863,19 @@ func fmtOut(out []byte) {
 	}
 }
 
-func fail(run string, stdout, stderr bytes.Buffer) {
-	msg(fmt.Sprintf("Run %v stdout:", run))
-	fmt.Print(stdout.String())
+func fail(r RunResult) {
+	msg(fmt.Sprintf("Run %v stdout:", r.run))
+	fmt.Fprint(console, r.stdout.String())
 
-	msg(fmt.Sprintf("Run %v stderr:", run))
-	fmt.Print(stderr.String())
+	msg(fmt.Sprintf("Run %v stderr:", r.run))
+	fmt.Fprint(console, r.stderr.String())
+
+	if len(r.artifacts) > 0 {
+		msg(fmt.Sprintf("Run %v artifacts:", r.run))
+		for _, path := range r.artifacts {
+			msg("  " + path)
+		}
+	}
 }
 
 func formatDuration(d time.Duration) string {
@@ -442,9 +883,9 @@ func formatDuration(d time.Duration) string {
 }
 
 func topic(name string) {
-	fmt.Printf("===> %s\n", name)
+	fmt.Fprintf(console, "===> %s\n", name)
 }
 
 func msg(name string) {
-	fmt.Printf("     %s\n", name)
+	fmt.Fprintf(console, "     %s\n", name)
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+var prefixColors = []string{"36", "33", "32", "35", "34", "31", "96", "93", "92", "95", "94", "91"}
+
+// OutputMux serializes output of concurrent runs into a single writer,
+// one complete line at a time, prefixing every line with the run id.
+type OutputMux struct {
+	sync.Mutex
+	out        io.Writer
+	color      bool
+	timestamps bool
+	width      int
+	colors     map[string]string
+}
+
+func NewOutputMux(out io.Writer, color, timestamps bool) *OutputMux {
+	return &OutputMux{
+		out:        out,
+		color:      color,
+		timestamps: timestamps,
+		colors:     make(map[string]string),
+	}
+}
+
+// Writer returns a line buffered writer for run. Flush must be called
+// once the run is done to emit any trailing partial line.
+func (m *OutputMux) Writer(run string) *LineWriter {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(run) > m.width {
+		m.width = len(run)
+	}
+
+	if _, ok := m.colors[run]; !ok {
+		m.colors[run] = prefixColors[len(m.colors)%len(prefixColors)]
+	}
+
+	return &LineWriter{
+		mux: m,
+		run: run,
+	}
+}
+
+func (m *OutputMux) writeLine(run string, line []byte) {
+	m.Lock()
+	defer m.Unlock()
+
+	prefix := run + strings.Repeat(" ", m.width-len(run)) + " |"
+	if m.color {
+		prefix = fmt.Sprintf("\x1b[%sm%s\x1b[0m", m.colors[run], prefix)
+	}
+	if m.timestamps {
+		prefix = time.Now().Format("15:04:05") + " " + prefix
+	}
+
+	fmt.Fprintf(m.out, "%s %s\n", prefix, line)
+}
+
+type LineWriter struct {
+	sync.Mutex
+	mux *OutputMux
+	run string
+	buf []byte
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.mux.writeLine(w.run, bytes.TrimRight(w.buf[:i], "\r"))
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes out any buffered partial line.
+func (w *LineWriter) Flush() {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.buf) > 0 {
+		w.mux.writeLine(w.run, w.buf)
+		w.buf = nil
+	}
+}
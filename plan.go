@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/pebblescape/pebblescape/pkg/table"
+)
+
+type PlanFile struct {
+	Path   string `json:"path"`
+	Weight int    `json:"weight"`
+}
+
+type PlanRun struct {
+	Run      string     `json:"run"`
+	Weight   int        `json:"weight"`
+	Features []PlanFile `json:"features,omitempty"`
+	Specs    []PlanFile `json:"specs,omitempty"`
+	Command  []string   `json:"command"`
+}
+
+type Plan struct {
+	Name      string    `json:"name"`
+	ID        string    `json:"id"`
+	Image     string    `json:"image"`
+	Seed      int       `json:"seed"`
+	NodeIndex int       `json:"node_index"`
+	NodeTotal int       `json:"node_total"`
+	Runs      []PlanRun `json:"runs"`
+}
+
+var planCommand = cli.Command{
+	Name:   "plan",
+	Usage:  "show how the build would be split up without running it",
+	Action: plan,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print plan as JSON",
+		},
+	},
+}
+
+func plan(c *cli.Context) {
+	// Keep messages out of the way of the JSON
+	if c.Bool("json") {
+		console = os.Stderr
+	}
+
+	b, err := newBuild(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := b.chdir(); err != nil {
+		log.Fatal(err)
+	}
+
+	features, err := b.selectFeatures()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	specs, err := b.selectSpecs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Shown as the build would use it, though the image may not be built
+	// yet and a prepared image is only committed once the build runs
+	if b.image, err = b.runImage(); err != nil {
+		log.Fatal(err)
+	}
+
+	p := Plan{
+		Name:      b.name,
+		ID:        b.id,
+		Image:     b.image,
+		Seed:      b.seed,
+		NodeIndex: b.nodeIndex,
+		NodeTotal: b.nodeTotal,
+		Runs:      make([]PlanRun, 0),
+	}
+
+	for _, s := range b.splits(features, specs) {
+		r := PlanRun{
+			Run:     s.run,
+			Weight:  s.weight(),
+			Command: append([]string{"docker"}, b.hosts[0].args(append(b.runArgs(b.hosts[0], s.run), s.cmd...)...)...),
+		}
+
+		for _, f := range s.features {
+			r.Features = append(r.Features, PlanFile{Path: f.Path, Weight: f.Weight})
+		}
+
+		for _, spec := range s.specs {
+			r.Specs = append(r.Specs, PlanFile{Path: spec.Path, Weight: spec.Weight})
+		}
+
+		p.Runs = append(p.Runs, r)
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(p); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	topic(fmt.Sprintf("Plan for build %s of %s in %v runs", p.ID, p.Name, len(p.Runs)))
+	if b.sharded() {
+		msg(fmt.Sprintf("Node %d of %d", p.NodeIndex, p.NodeTotal))
+	}
+	msg(fmt.Sprintf("Seed %d", p.Seed))
+	msg(fmt.Sprintf("Image %s, for the build context as it is now", p.Image))
+
+	for _, r := range p.Runs {
+		topic(fmt.Sprintf("Run %s, weight %d", r.Run, r.Weight))
+
+		if len(r.Features)+len(r.Specs) > 0 {
+			filesTbl := table.New(2)
+
+			for _, f := range append(r.Features, r.Specs...) {
+				filesTbl.Add(f.Path, strconv.Itoa(f.Weight))
+			}
+
+			fmt.Print(filesTbl.String())
+		}
+
+		msg(strings.Join(r.Command, " "))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/krisrang/cirunner/junit"
+)
+
+// Exit code of the build under the policy given the results of its splits,
+// along with why
+func (p Policy) exitCode(b *Build, results []RunResult, splits []Split) (int, string) {
+	byRun := make(map[string]Split)
+	for _, s := range splits {
+		byRun[s.run] = s
+	}
+
+	worst := statusPassed
+	infra := false
+	failed := false
+	failedTests := 0
+	uncounted := false
+
+	for _, r := range results {
+		s := byRun[r.run]
+		if !b.blocking(s) {
+			continue
+		}
+
+		switch r.status {
+		case statusCancelled:
+			return exitAborted, "cancelled"
+		case statusInfra:
+			if p.InfraUnstable {
+				infra = true
+				continue
+			}
+		case statusFailed:
+			failed = true
+
+			// A failed run without failed tests in its reports failed some
+			// other way and can't be allowed
+			suites, err := junit.ParseDir(s.reportDir())
+			n := len(junit.Failed(suites))
+			if err != nil || n == 0 {
+				uncounted = true
+			}
+			failedTests += n
+			continue
+		}
+
+		if r.status > worst {
+			worst = r.status
+		}
+	}
+
+	if failed && worst < statusFailed {
+		if uncounted || failedTests > p.AllowedFailures {
+			worst = statusFailed
+		} else {
+			msg(fmt.Sprintf("%d failed test(s) within the %d allowed", failedTests, p.AllowedFailures))
+		}
+	}
+
+	if worst == statusPassed && infra {
+		return p.UnstableExitCode, "unstable"
+	}
+
+	return worst.exitCode(), worst.String()
+}
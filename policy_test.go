@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyExitCode(t *testing.T) {
+	dir := tempDir(t)
+
+	// Runs whose reports have n failed tests, or none for -1
+	split := func(run, suite string, n int) Split {
+		s := Split{
+			run:        run,
+			suite:      suite,
+			reportSrc:  "features/reports",
+			reportDest: filepath.Join(dir, run),
+		}
+
+		if n >= 0 {
+			cases := strings.Repeat(`<testcase name="t" file="./features/a.feature"><failure message="boom"/></testcase>`, n)
+			writeFile(t, s.reportDir(), "TEST-a.xml", fmt.Sprintf(`<testsuite failures="%d">%s</testsuite>`, n, cases))
+		}
+
+		return s
+	}
+
+	splits := []Split{
+		split("passed", "", 0),
+		split("one", "", 1),
+		split("two", "", 2),
+		split("uncounted", "", -1),
+		split("smoke", "smoke", 3),
+		split("other", "", 0),
+	}
+
+	b := &Build{config: &Config{Suites: []Suite{{Name: "smoke", NonBlocking: true}}}}
+
+	result := func(run string, status Status) RunResult {
+		return RunResult{run: run, status: status}
+	}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		results []RunResult
+		code    int
+	}{
+		{"passed", Policy{}, []RunResult{result("passed", statusPassed)}, exitPassed},
+		{"failed", Policy{}, []RunResult{result("one", statusFailed)}, exitFailed},
+		{"within allowed failures", Policy{AllowedFailures: 1}, []RunResult{result("passed", statusPassed), result("one", statusFailed)}, exitPassed},
+		{"allowed failures add up", Policy{AllowedFailures: 2}, []RunResult{result("one", statusFailed), result("two", statusFailed)}, exitFailed},
+		{"uncounted failure", Policy{AllowedFailures: 5}, []RunResult{result("uncounted", statusFailed)}, exitFailed},
+		{"non-blocking suite", Policy{}, []RunResult{result("passed", statusPassed), result("smoke", statusFailed)}, exitPassed},
+		{"non-blocking failures not counted", Policy{AllowedFailures: 1}, []RunResult{result("one", statusFailed), result("smoke", statusFailed)}, exitPassed},
+		{"infra", Policy{}, []RunResult{result("passed", statusPassed), result("other", statusInfra)}, exitInfra},
+		{"infra unstable", Policy{InfraUnstable: true, UnstableExitCode: exitUnstable}, []RunResult{result("passed", statusPassed), result("other", statusInfra)}, exitUnstable},
+		{"infra unstable and failed", Policy{InfraUnstable: true, UnstableExitCode: exitUnstable}, []RunResult{result("one", statusFailed), result("other", statusInfra)}, exitFailed},
+		{"infra unstable and timeout", Policy{InfraUnstable: true, UnstableExitCode: exitUnstable}, []RunResult{result("passed", statusTimeout), result("other", statusInfra)}, exitTimeout},
+		{"infra over timeout", Policy{}, []RunResult{result("passed", statusTimeout), result("other", statusInfra)}, exitInfra},
+		{"timeout over failed", Policy{}, []RunResult{result("one", statusFailed), result("passed", statusTimeout)}, exitTimeout},
+		{"cancelled", Policy{InfraUnstable: true}, []RunResult{result("other", statusInfra), result("passed", statusCancelled)}, exitAborted},
+	}
+
+	for _, tt := range tests {
+		if code, reason := tt.policy.exitCode(b, tt.results, splits); code != tt.code {
+			t.Errorf("%s: exitCode = %d (%s), want %d", tt.name, code, reason, tt.code)
+		}
+	}
+}
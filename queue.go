@@ -0,0 +1,186 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Queue hands out the splits of a build to local runners and remote
+// workers. Splits leased by remote workers are requeued when the worker
+// stops sending heartbeats.
+type Queue struct {
+	sync.Mutex
+	cond    *sync.Cond
+	pending []Split
+	leases  map[string]*lease
+	done    map[string]bool
+	total   int
+}
+
+type lease struct {
+	split   Split
+	worker  string
+	expires time.Time
+}
+
+func NewQueue(splits []Split) *Queue {
+	q := &Queue{
+		pending: append([]Split{}, splits...),
+		leases:  make(map[string]*lease),
+		done:    make(map[string]bool),
+		total:   len(splits),
+	}
+	q.cond = sync.NewCond(q)
+
+	return q
+}
+
+// Next blocks until a split is available and leases it without expiry for
+// a local runner. Returns false once all splits are done.
+func (q *Queue) Next() (Split, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.pending) == 0 && len(q.done) < q.total {
+		q.cond.Wait()
+	}
+
+	if len(q.pending) == 0 {
+		return Split{}, false
+	}
+
+	return q.take("local", time.Time{}), true
+}
+
+// Lease hands a split to worker if one is pending, it has to be renewed
+// by heartbeats within ttl
+func (q *Queue) Lease(worker string, ttl time.Duration) (Split, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.pending) == 0 {
+		return Split{}, false
+	}
+
+	return q.take(worker, time.Now().Add(ttl)), true
+}
+
+func (q *Queue) take(worker string, expires time.Time) Split {
+	s := q.pending[0]
+	q.pending = q.pending[1:]
+	q.leases[s.run] = &lease{
+		split:   s,
+		worker:  worker,
+		expires: expires,
+	}
+
+	return s
+}
+
+// Heartbeat extends the lease of run, returns false if worker no longer
+// holds it
+func (q *Queue) Heartbeat(worker, run string, ttl time.Duration) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	l, ok := q.leases[run]
+	if !ok || l.worker != worker {
+		return false
+	}
+
+	l.expires = time.Now().Add(ttl)
+	return true
+}
+
+// Holds reports whether worker holds an unexpired lease of run, which
+// isn't done then either
+func (q *Queue) Holds(worker, run string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	l, ok := q.leases[run]
+	return ok && l.worker == worker && (l.expires.IsZero() || time.Now().Before(l.expires))
+}
+
+// Release requeues run if worker holds its lease, for workers that stop
+// without finishing it
+func (q *Queue) Release(worker, run string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	l, ok := q.leases[run]
+	if !ok || l.worker != worker {
+		return false
+	}
+
+	delete(q.leases, run)
+	q.pending = append(q.pending, l.split)
+	q.cond.Broadcast()
+
+	return true
+}
+
+// Complete marks run as done, returns false if it was done already
+func (q *Queue) Complete(run string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.done[run] {
+		return false
+	}
+
+	// A requeued split may be finished by the worker that lost it
+	for i, s := range q.pending {
+		if s.run == run {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+
+	delete(q.leases, run)
+	q.done[run] = true
+	q.cond.Broadcast()
+
+	return true
+}
+
+// Expire requeues splits whose lease has run out
+func (q *Queue) Expire() []string {
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	expired := make([]string, 0)
+
+	for run, l := range q.leases {
+		if !l.expires.IsZero() && now.After(l.expires) {
+			delete(q.leases, run)
+			q.pending = append(q.pending, l.split)
+			expired = append(expired, run)
+		}
+	}
+
+	if len(expired) > 0 {
+		q.cond.Broadcast()
+	}
+
+	return expired
+}
+
+// Finished reports whether all splits are done
+func (q *Queue) Finished() bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.done) == q.total
+}
+
+// Wait blocks until all splits are done
+func (q *Queue) Wait() {
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.done) < q.total {
+		q.cond.Wait()
+	}
+}
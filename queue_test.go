@@ -0,0 +1,176 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func testQueue(runs ...string) *Queue {
+	splits := make([]Split, 0, len(runs))
+	for _, run := range runs {
+		splits = append(splits, Split{run: run})
+	}
+
+	return NewQueue(splits)
+}
+
+func TestQueueLease(t *testing.T) {
+	q := testQueue("1", "2")
+
+	s, ok := q.Lease("a", time.Hour)
+	if !ok || s.run != "1" {
+		t.Fatalf("Lease = %v %v, want run 1", s.run, ok)
+	}
+
+	if s, ok = q.Lease("b", -time.Second); !ok || s.run != "2" {
+		t.Fatalf("Lease = %v %v, want run 2", s.run, ok)
+	}
+
+	if _, ok = q.Lease("c", time.Hour); ok {
+		t.Fatalf("Lease with nothing pending succeeded")
+	}
+
+	tests := []struct {
+		name   string
+		worker string
+		run    string
+		holds  bool
+	}{
+		{"holder", "a", "1", true},
+		{"other worker", "b", "1", false},
+		{"expired", "b", "2", false},
+		{"unknown run", "a", "3", false},
+	}
+
+	for _, tt := range tests {
+		if got := q.Holds(tt.worker, tt.run); got != tt.holds {
+			t.Errorf("%s: Holds(%s, %s) = %v, want %v", tt.name, tt.worker, tt.run, got, tt.holds)
+		}
+	}
+
+	if expired := q.Expire(); !reflect.DeepEqual(expired, []string{"2"}) {
+		t.Fatalf("Expire = %v, want [2]", expired)
+	}
+
+	if q.Heartbeat("b", "2", time.Hour) {
+		t.Errorf("Heartbeat of an expired lease succeeded")
+	}
+	if !q.Heartbeat("a", "1", time.Hour) {
+		t.Errorf("Heartbeat of a held lease failed")
+	}
+
+	// Requeued for someone else
+	if s, ok = q.Lease("c", time.Hour); !ok || s.run != "2" {
+		t.Fatalf("Lease after expiry = %v %v, want run 2", s.run, ok)
+	}
+	if !q.Holds("c", "2") || q.Holds("b", "2") {
+		t.Errorf("Lease of run 2 not moved to c")
+	}
+}
+
+func TestQueueRelease(t *testing.T) {
+	q := testQueue("1")
+	q.Lease("a", time.Hour)
+
+	if q.Release("b", "1") {
+		t.Errorf("Release by a worker not holding the lease succeeded")
+	}
+	if !q.Release("a", "1") {
+		t.Fatalf("Release by the holder failed")
+	}
+	if q.Release("a", "1") {
+		t.Errorf("Release of a released lease succeeded")
+	}
+
+	if s, ok := q.Lease("b", time.Hour); !ok || s.run != "1" {
+		t.Errorf("Lease after release = %v %v, want run 1", s.run, ok)
+	}
+}
+
+func TestQueueComplete(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(q *Queue)
+		pending []string
+	}{
+		{"leased", func(q *Queue) { q.Lease("a", time.Hour) }, []string{"2"}},
+		{"requeued", func(q *Queue) { q.Lease("a", -time.Second); q.Expire() }, []string{"2"}},
+		{"pending", func(q *Queue) {}, []string{"2"}},
+	}
+
+	for _, tt := range tests {
+		q := testQueue("1", "2")
+		tt.prepare(q)
+
+		if !q.Complete("1") {
+			t.Errorf("%s: Complete failed", tt.name)
+		}
+		if q.Complete("1") {
+			t.Errorf("%s: Complete of a done run succeeded", tt.name)
+		}
+
+		pending := make([]string, 0)
+		for _, s := range q.pending {
+			pending = append(pending, s.run)
+		}
+		sort.Strings(pending)
+
+		if !reflect.DeepEqual(pending, tt.pending) {
+			t.Errorf("%s: pending = %v, want %v", tt.name, pending, tt.pending)
+		}
+		if q.Holds("a", "1") {
+			t.Errorf("%s: lease of a done run still held", tt.name)
+		}
+		if q.Finished() {
+			t.Errorf("%s: finished with run 2 pending", tt.name)
+		}
+	}
+}
+
+func TestQueueNext(t *testing.T) {
+	type next struct {
+		run string
+		ok  bool
+	}
+
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		unblock func(q *Queue)
+		want    next
+	}{
+		{"last remote lease completes", time.Hour, func(q *Queue) { q.Complete("1") }, next{"", false}},
+		{"remote lease expires", -time.Second, func(q *Queue) { q.Expire() }, next{"1", true}},
+		{"remote lease released", time.Hour, func(q *Queue) { q.Release("a", "1") }, next{"1", true}},
+	}
+
+	for _, tt := range tests {
+		q := testQueue("1")
+		q.Lease("a", tt.ttl)
+
+		done := make(chan next)
+		go func() {
+			s, ok := q.Next()
+			done <- next{s.run, ok}
+		}()
+
+		select {
+		case got := <-done:
+			t.Fatalf("%s: Next returned %v before the lease ended", tt.name, got)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		tt.unblock(q)
+
+		select {
+		case got := <-done:
+			if got != tt.want {
+				t.Errorf("%s: Next = %v, want %v", tt.name, got, tt.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: Next still blocked", tt.name)
+		}
+	}
+}
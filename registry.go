@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Registry keeps track of the docker resources a build creates, so every
+// teardown path removes exactly what was created.
+type Registry struct {
+	sync.Mutex
+	host      *DockerHost
+	resources map[string][]string
+}
+
+func NewRegistry(host *DockerHost) *Registry {
+	return &Registry{
+		host:      host,
+		resources: make(map[string][]string),
+	}
+}
+
+// Track registers a resource of kind. Resources should be tracked before
+// they are created, so a build torn down halfway doesn't miss them.
+func (r *Registry) Track(kind string, names ...string) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, name := range names {
+		if !contains(r.resources[kind], name) {
+			r.resources[kind] = append(r.resources[kind], name)
+		}
+	}
+}
+
+// Release removes the given tracked resources and forgets them.
+func (r *Registry) Release(kind string, names ...string) error {
+	r.Forget(kind, names...)
+
+	return removeResource(r.host, kind, names...)
+}
+
+// Forget stops tracking resources that are removed by other means, such as
+// containers run with --rm.
+func (r *Registry) Forget(kind string, names ...string) {
+	r.Lock()
+	defer r.Unlock()
+
+	remaining := make([]string, 0)
+	for _, name := range r.resources[kind] {
+		if !contains(names, name) {
+			remaining = append(remaining, name)
+		}
+	}
+	r.resources[kind] = remaining
+}
+
+// Teardown removes all tracked resources.
+func (r *Registry) Teardown() {
+	r.Lock()
+	resources := r.resources
+	r.resources = make(map[string][]string)
+	r.Unlock()
+
+	for _, kind := range resourceKinds {
+		if err := removeResource(r.host, kind.name, resources[kind.name]...); err != nil && verbose {
+			msg(err.Error())
+		}
+	}
+}
+
+func removeResource(host *DockerHost, kind string, names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	for _, k := range resourceKinds {
+		if k.name != kind {
+			continue
+		}
+
+		if err, _, stderr := host.docker(veryverbose, append(k.rm, names...)...); err != nil {
+			return fmt.Errorf("Removing %ss failed: %v\n%s", kind, err, stderr.String())
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("Unknown resource kind %s", kind)
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
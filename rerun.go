@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Cucumber's rerun formatter lists the failed scenarios of a run in this
+// file of its reports, a run may fail because of scenarios besides the one
+// of interest
+const rerunFile = "rerun.txt"
+
+// Scenarios of a cucumber run that failed, like features/checkout.feature:12
+func (s Split) failedScenarios() ([]string, error) {
+	return readRerun(filepath.Join(s.reportDir(), rerunFile))
+}
+
+// Scenarios in a rerun file, a missing file has none
+func readRerun(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scenarios := make([]string, 0)
+	for _, entry := range strings.Fields(string(b)) {
+		parts := strings.Split(entry, ":")
+		if len(parts) == 1 {
+			scenarios = append(scenarios, entry)
+			continue
+		}
+
+		// Scenarios of the same feature are listed like features/a.feature:3:7
+		for _, line := range parts[1:] {
+			scenarios = append(scenarios, parts[0]+":"+line)
+		}
+	}
+
+	return scenarios, nil
+}
+
+// Whether scenario, or any scenario of it when it's a feature, is in failed
+func rerunIncludes(failed []string, scenario string) bool {
+	for _, f := range failed {
+		if f == scenario || strings.HasPrefix(f, scenario+":") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package rspec
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type SpecFile struct {
+	Path   string
+	Weight int
+}
+
+type ByWeight []SpecFile
+
+func (a ByWeight) Len() int           { return len(a) }
+func (a ByWeight) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByWeight) Less(i, j int) bool { return a[i].Weight > a[j].Weight }
+
+var exampleRegexp = regexp.MustCompile(`^\s*(it|specify|example|scenario|its)\b`)
+
+// Filter decides whether a spec file is selected
+type Filter func(path string) bool
+
+// Select finds all spec files accepted by filters, weighed by the number
+// of examples in them
+func Select(filters ...Filter) ([]SpecFile, error) {
+	specs := make([]SpecFile, 0)
+	files := make([]string, 0)
+
+	visit := func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasSuffix(path, "_spec.rb") && accept(filters, path) {
+			files = append(files, path)
+		}
+
+		return nil
+	}
+
+	err := filepath.Walk("spec", visit)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		weight, err := CountExamples(f)
+		if err != nil {
+			return nil, err
+		}
+
+		specs = append(specs, SpecFile{
+			Path:   f,
+			Weight: weight,
+		})
+	}
+
+	sort.Sort(ByWeight(specs))
+
+	return specs, nil
+}
+
+func accept(filters []Filter, path string) bool {
+	for _, filter := range filters {
+		if !filter(path) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CountExamples counts lines defining examples in a spec file, every file
+// weighs at least 1
+func CountExamples(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		if exampleRegexp.MatchString(scanner.Text()) {
+			count++
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if count == 0 {
+		count = 1
+	}
+
+	return count, nil
+}
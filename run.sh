@@ -1,3 +1,3 @@
 #!/bin/bash
 
-go run main.go --name skyltmax --path /Users/Kris/Code/skyltmax --tags ~@wip --tags ~@firebug --tags ~@skipci --slowtags @slow_motion $@
+go run . --name skyltmax --path /Users/Kris/Code/skyltmax --tags ~@wip --tags ~@firebug --tags ~@skipci --slowtags @slow_motion $@
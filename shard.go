@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/krisrang/cirunner/cucumber"
+	"github.com/krisrang/cirunner/rspec"
+)
+
+type shardItem struct {
+	index  int
+	key    string
+	weight int
+}
+
+// Deterministically partition items over total nodes balancing their
+// weights, returns indexes of the items assigned to node index. Every node
+// computes the same partition as long as it's given the same items.
+func shard(keys []string, weights []int, index, total int) []int {
+	items := make([]shardItem, len(keys))
+	for i := range keys {
+		items[i] = shardItem{i, keys[i], weights[i]}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].weight != items[j].weight {
+			return items[i].weight > items[j].weight
+		}
+		return items[i].key < items[j].key
+	})
+
+	load := make([]int, total)
+	result := make([]int, 0)
+
+	for _, item := range items {
+		node := 0
+		for n := range load {
+			if load[n] < load[node] {
+				node = n
+			}
+		}
+
+		load[node] += item.weight
+		if node == index {
+			result = append(result, item.index)
+		}
+	}
+
+	sort.Ints(result)
+
+	return result
+}
+
+func (b *Build) sharded() bool {
+	return b.nodeTotal > 1
+}
+
+func (b *Build) validateShard() error {
+	if b.nodeTotal < 1 || b.nodeIndex < 0 || b.nodeIndex >= b.nodeTotal {
+		return fmt.Errorf("Invalid node index %d of %d nodes", b.nodeIndex, b.nodeTotal)
+	}
+
+	return nil
+}
+
+func shardFeatures(features []cucumber.FeatureFile, index, total int) []cucumber.FeatureFile {
+	keys := make([]string, len(features))
+	weights := make([]int, len(features))
+	for i, f := range features {
+		keys[i] = f.Path
+		weights[i] = f.Weight
+	}
+
+	result := make([]cucumber.FeatureFile, 0)
+	for _, i := range shard(keys, weights, index, total) {
+		result = append(result, features[i])
+	}
+
+	return result
+}
+
+func shardSpecs(specs []rspec.SpecFile, index, total int) []rspec.SpecFile {
+	keys := make([]string, len(specs))
+	weights := make([]int, len(specs))
+	for i, s := range specs {
+		keys[i] = s.Path
+		weights[i] = s.Weight
+	}
+
+	result := make([]rspec.SpecFile, 0)
+	for _, i := range shard(keys, weights, index, total) {
+		result = append(result, specs[i])
+	}
+
+	return result
+}
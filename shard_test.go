@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/krisrang/cirunner/cucumber"
+	"github.com/krisrang/cirunner/rspec"
+)
+
+func TestShard(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		weights []int
+		total   int
+		want    [][]int
+	}{
+		{"one node", []string{"a", "b", "c"}, []int{1, 2, 3}, 1, [][]int{{0, 1, 2}}},
+		{"balanced by weight", []string{"a", "b", "c", "d"}, []int{5, 3, 3, 1}, 2, [][]int{{0, 3}, {1, 2}}},
+		{"ties broken by key", []string{"c", "a", "b"}, []int{1, 1, 1}, 3, [][]int{{1}, {2}, {0}}},
+		{"more nodes than items", []string{"a", "b"}, []int{1, 1}, 3, [][]int{{0}, {1}, {}}},
+		{"no items", []string{}, []int{}, 2, [][]int{{}, {}}},
+	}
+
+	for _, tt := range tests {
+		for index, want := range tt.want {
+			if got := shard(tt.keys, tt.weights, index, tt.total); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: shard node %d = %v, want %v", tt.name, index, got, want)
+			}
+		}
+	}
+}
+
+func TestShardPartitions(t *testing.T) {
+	keys := []string{"f", "e", "d", "c", "b", "a", "g"}
+	weights := []int{4, 1, 7, 2, 2, 9, 1}
+
+	for total := 1; total <= len(keys)+1; total++ {
+		seen := make(map[int]int)
+		for index := 0; index < total; index++ {
+			for _, i := range shard(keys, weights, index, total) {
+				seen[i]++
+			}
+		}
+
+		for i := range keys {
+			if seen[i] != 1 {
+				t.Errorf("%d nodes: item %s assigned %d times", total, keys[i], seen[i])
+			}
+		}
+	}
+}
+
+func TestShardFeatures(t *testing.T) {
+	features := []cucumber.FeatureFile{
+		{Path: "features/a.feature", Weight: 5},
+		{Path: "features/b.feature", Weight: 3},
+		{Path: "features/c.feature", Weight: 3},
+		{Path: "features/d.feature", Weight: 1},
+	}
+
+	// Nodes listing the features in another order get the same shards
+	reversed := make([]cucumber.FeatureFile, len(features))
+	for i, f := range features {
+		reversed[len(features)-1-i] = f
+	}
+
+	tests := []struct {
+		index int
+		want  []string
+	}{
+		{0, []string{"features/a.feature", "features/d.feature"}},
+		{1, []string{"features/b.feature", "features/c.feature"}},
+	}
+
+	for _, tt := range tests {
+		for _, fs := range [][]cucumber.FeatureFile{features, reversed} {
+			got := make(map[string]bool)
+			for _, f := range shardFeatures(fs, tt.index, 2) {
+				got[f.Path] = true
+			}
+
+			if len(got) != len(tt.want) {
+				t.Errorf("shardFeatures node %d = %v, want %v", tt.index, got, tt.want)
+			}
+			for _, path := range tt.want {
+				if !got[path] {
+					t.Errorf("shardFeatures node %d = %v, want %v", tt.index, got, tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestShardSpecs(t *testing.T) {
+	specs := []rspec.SpecFile{
+		{Path: "spec/a_spec.rb", Weight: 2},
+		{Path: "spec/b_spec.rb", Weight: 2},
+		{Path: "spec/c_spec.rb", Weight: 2},
+	}
+
+	tests := []struct {
+		index int
+		want  []rspec.SpecFile
+	}{
+		{0, []rspec.SpecFile{specs[0], specs[2]}},
+		{1, []rspec.SpecFile{specs[1]}},
+	}
+
+	for _, tt := range tests {
+		if got := shardSpecs(specs, tt.index, 2); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("shardSpecs node %d = %v, want %v", tt.index, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package simplecov
+
+import (
+	"encoding/xml"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type coberturaCoverage struct {
+	XMLName         xml.Name           `xml:"coverage"`
+	LineRate        string             `xml:"line-rate,attr"`
+	BranchRate      string             `xml:"branch-rate,attr"`
+	LinesCovered    int                `xml:"lines-covered,attr"`
+	LinesValid      int                `xml:"lines-valid,attr"`
+	BranchesCovered int                `xml:"branches-covered,attr"`
+	BranchesValid   int                `xml:"branches-valid,attr"`
+	Complexity      int                `xml:"complexity,attr"`
+	Version         string             `xml:"version,attr"`
+	Timestamp       int64              `xml:"timestamp,attr"`
+	Sources         []string           `xml:"sources>source"`
+	Packages        []coberturaPackage `xml:"packages>package"`
+}
+
+type coberturaPackage struct {
+	Name       string           `xml:"name,attr"`
+	LineRate   string           `xml:"line-rate,attr"`
+	BranchRate string           `xml:"branch-rate,attr"`
+	Complexity int              `xml:"complexity,attr"`
+	Classes    []coberturaClass `xml:"classes>class"`
+}
+
+type coberturaClass struct {
+	Name       string          `xml:"name,attr"`
+	Filename   string          `xml:"filename,attr"`
+	LineRate   string          `xml:"line-rate,attr"`
+	BranchRate string          `xml:"branch-rate,attr"`
+	Complexity int             `xml:"complexity,attr"`
+	Methods    struct{}        `xml:"methods"`
+	Lines      []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaLine struct {
+	Number int    `xml:"number,attr"`
+	Hits   int    `xml:"hits,attr"`
+	Branch string `xml:"branch,attr"`
+}
+
+// WriteCobertura writes the result as a Cobertura XML report, with file
+// paths made relative to root, the directory the app lives in
+func (r Result) WriteCobertura(w io.Writer, root string) error {
+	root = strings.TrimSuffix(root, "/") + "/"
+
+	files := make([]string, 0, len(r.Coverage))
+	for file := range r.Coverage {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	packages := make(map[string]*coberturaPackage)
+	pkgCounts := make(map[string][2]int)
+	names := make([]string, 0)
+
+	for _, file := range files {
+		rel := strings.TrimPrefix(file, root)
+		dir := path.Dir(rel)
+
+		pkg, ok := packages[dir]
+		if !ok {
+			pkg = &coberturaPackage{Name: dir, BranchRate: "0"}
+			packages[dir] = pkg
+			names = append(names, dir)
+		}
+
+		class := coberturaClass{
+			Name:       strings.TrimSuffix(path.Base(rel), path.Ext(rel)),
+			Filename:   rel,
+			BranchRate: "0",
+		}
+
+		covered, valid := 0, 0
+		for i, hits := range r.Coverage[file].Lines {
+			if hits == nil {
+				continue
+			}
+
+			valid++
+			if *hits > 0 {
+				covered++
+			}
+
+			class.Lines = append(class.Lines, coberturaLine{Number: i + 1, Hits: *hits, Branch: "false"})
+		}
+
+		class.LineRate = rate(covered, valid)
+		pkg.Classes = append(pkg.Classes, class)
+
+		counts := pkgCounts[dir]
+		pkgCounts[dir] = [2]int{counts[0] + covered, counts[1] + valid}
+	}
+
+	covered, valid := r.Lines()
+	report := coberturaCoverage{
+		LineRate:     rate(covered, valid),
+		BranchRate:   "0",
+		LinesCovered: covered,
+		LinesValid:   valid,
+		Version:      "0",
+		Timestamp:    r.Timestamp * 1000,
+		Sources:      []string{strings.TrimSuffix(root, "/")},
+	}
+
+	for _, name := range names {
+		pkg := packages[name]
+		pkg.LineRate = rate(pkgCounts[name][0], pkgCounts[name][1])
+		report.Packages = append(report.Packages, *pkg)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func rate(covered, valid int) string {
+	if valid == 0 {
+		return "1"
+	}
+
+	return strconv.FormatFloat(float64(covered)/float64(valid), 'f', 4, 64)
+}
@@ -0,0 +1,171 @@
+package simplecov
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Resultset is the contents of a .resultset.json, results by command name
+type Resultset map[string]Result
+
+type Result struct {
+	Coverage  map[string]FileCoverage `json:"coverage"`
+	Timestamp int64                   `json:"timestamp"`
+}
+
+// FileCoverage holds the hits of every line of a source file, nil for lines
+// that aren't code
+type FileCoverage struct {
+	Lines    []*int          `json:"lines"`
+	Branches json.RawMessage `json:"branches,omitempty"`
+}
+
+// UnmarshalJSON also reads the plain line arrays older SimpleCov versions
+// write
+func (fc *FileCoverage) UnmarshalJSON(b []byte) error {
+	var lines []*int
+	if err := json.Unmarshal(b, &lines); err == nil {
+		fc.Lines = lines
+		return nil
+	}
+
+	type fileCoverage FileCoverage
+	return json.Unmarshal(b, (*fileCoverage)(fc))
+}
+
+// Covered reports whether any line of the file was hit
+func (fc FileCoverage) Covered() bool {
+	for _, hits := range fc.Lines {
+		if hits != nil && *hits > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseFile reads the resultset at path
+func ParseFile(path string) (Resultset, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rs := make(Resultset)
+	if err := json.NewDecoder(f).Decode(&rs); err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// ParseDir reads all .resultset.json files in dir and its subdirectories,
+// a missing dir has none
+func ParseDir(dir string) ([]Resultset, error) {
+	resultsets := make([]Resultset, 0)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || info.Name() != ".resultset.json" {
+			return nil
+		}
+
+		rs, err := ParseFile(path)
+		if err != nil {
+			return err
+		}
+
+		resultsets = append(resultsets, rs)
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		return resultsets, nil
+	}
+
+	return resultsets, err
+}
+
+// Merge combines the results of resultsets into a single result under
+// command, adding up the hits of every line. Branch coverage isn't merged.
+func Merge(resultsets []Resultset, command string) Resultset {
+	merged := Result{Coverage: make(map[string]FileCoverage)}
+
+	for _, rs := range resultsets {
+		for _, result := range rs {
+			if result.Timestamp > merged.Timestamp {
+				merged.Timestamp = result.Timestamp
+			}
+
+			for path, fc := range result.Coverage {
+				merged.Coverage[path] = FileCoverage{Lines: mergeLines(merged.Coverage[path].Lines, fc.Lines)}
+			}
+		}
+	}
+
+	return Resultset{command: merged}
+}
+
+func mergeLines(a, b []*int) []*int {
+	if len(b) > len(a) {
+		a, b = b, a
+	}
+
+	lines := make([]*int, len(a))
+	for i := range a {
+		var other *int
+		if i < len(b) {
+			other = b[i]
+		}
+
+		switch {
+		case a[i] == nil && other == nil:
+		case a[i] == nil:
+			hits := *other
+			lines[i] = &hits
+		case other == nil:
+			hits := *a[i]
+			lines[i] = &hits
+		default:
+			hits := *a[i] + *other
+			lines[i] = &hits
+		}
+	}
+
+	return lines
+}
+
+// WriteFile writes the resultset to path the way SimpleCov does
+func (rs Resultset) WriteFile(path string) error {
+	b, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0666)
+}
+
+// Lines returns the number of code lines in the result and how many of them
+// were hit
+func (r Result) Lines() (covered, valid int) {
+	for _, fc := range r.Coverage {
+		for _, hits := range fc.Lines {
+			if hits == nil {
+				continue
+			}
+
+			valid++
+			if *hits > 0 {
+				covered++
+			}
+		}
+	}
+
+	return covered, valid
+}
@@ -0,0 +1,125 @@
+package simplecov
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Lines from a JSON array, like [1, null, 0]
+func lines(t *testing.T, s string) []*int {
+	var l []*int
+	if err := json.Unmarshal([]byte(s), &l); err != nil {
+		t.Fatal(err)
+	}
+
+	return l
+}
+
+func TestMergeLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"hits summed", "[1, 2, 0]", "[3, 0, 0]", "[4, 2, 0]"},
+		{"non code lines kept", "[null, 1]", "[null, 2]", "[null, 3]"},
+		{"code on one side", "[null, 1]", "[2, null]", "[2, 1]"},
+		{"first longer", "[1, 1, 1]", "[1]", "[2, 1, 1]"},
+		{"second longer", "[1]", "[1, null, 5]", "[2, null, 5]"},
+		{"first empty", "[]", "[0, null]", "[0, null]"},
+		{"both empty", "[]", "[]", "[]"},
+	}
+
+	for _, tt := range tests {
+		got := mergeLines(lines(t, tt.a), lines(t, tt.b))
+		if want := lines(t, tt.want); !reflect.DeepEqual(got, want) {
+			gotJSON, _ := json.Marshal(got)
+			t.Errorf("%s: mergeLines(%s, %s) = %s, want %s", tt.name, tt.a, tt.b, gotJSON, tt.want)
+		}
+	}
+}
+
+func TestMergeLinesCopies(t *testing.T) {
+	a := lines(t, "[1, null]")
+	merged := mergeLines(a, nil)
+	*merged[0] = 5
+
+	if *a[0] != 1 {
+		t.Errorf("mergeLines shares hits with its input")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	parse := func(s string) Resultset {
+		rs := make(Resultset)
+		if err := json.Unmarshal([]byte(s), &rs); err != nil {
+			t.Fatal(err)
+		}
+		return rs
+	}
+
+	tests := []struct {
+		name       string
+		resultsets []string
+		want       map[string]string
+		timestamp  int64
+	}{
+		{
+			"none",
+			[]string{},
+			map[string]string{},
+			0,
+		},
+		{
+			"commands of a resultset",
+			[]string{`{
+				"RSpec 1": {"coverage": {"/app/a.rb": {"lines": [1, null, 0]}}, "timestamp": 1},
+				"RSpec 2": {"coverage": {"/app/a.rb": {"lines": [0, null, 2]}}, "timestamp": 3}
+			}`},
+			map[string]string{"/app/a.rb": "[1, null, 2]"},
+			3,
+		},
+		{
+			"legacy line arrays",
+			[]string{
+				`{"Cucumber": {"coverage": {"/app/a.rb": [1, null], "/app/b.rb": [0]}, "timestamp": 2}}`,
+				`{"RSpec": {"coverage": {"/app/a.rb": {"lines": [2, null, 1]}}, "timestamp": 1}}`,
+			},
+			map[string]string{"/app/a.rb": "[3, null, 1]", "/app/b.rb": "[0]"},
+			2,
+		},
+	}
+
+	for _, tt := range tests {
+		resultsets := make([]Resultset, 0, len(tt.resultsets))
+		for _, s := range tt.resultsets {
+			resultsets = append(resultsets, parse(s))
+		}
+
+		merged := Merge(resultsets, "cirunner")
+		if len(merged) != 1 {
+			t.Fatalf("%s: Merge returned %d commands, want 1", tt.name, len(merged))
+		}
+
+		result, ok := merged["cirunner"]
+		if !ok {
+			t.Fatalf("%s: Merge result not under the given command", tt.name)
+		}
+
+		if result.Timestamp != tt.timestamp {
+			t.Errorf("%s: timestamp = %d, want %d", tt.name, result.Timestamp, tt.timestamp)
+		}
+
+		if len(result.Coverage) != len(tt.want) {
+			t.Errorf("%s: coverage of %d files, want %d", tt.name, len(result.Coverage), len(tt.want))
+		}
+
+		for path, want := range tt.want {
+			got, _ := json.Marshal(result.Coverage[path].Lines)
+			if !reflect.DeepEqual(result.Coverage[path].Lines, lines(t, want)) {
+				t.Errorf("%s: lines of %s = %s, want %s", tt.name, path, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// Exit codes of a build, decided by the worst status of its runs and the
+// policy of the project
+const (
+	exitPassed   = 0
+	exitFailed   = 1
+	exitInfra    = 2
+	exitTimeout  = 3
+	exitUnstable = 4
+	exitAborted  = 130
+)
+
+// Status of a finished run
+type Status int
+
+const (
+	statusPassed Status = iota
+	statusFailed
+	statusTimeout
+	statusInfra
+	statusCancelled
+)
+
+var statusNames = map[Status]string{
+	statusPassed:    "passed",
+	statusFailed:    "test-failed",
+	statusTimeout:   "timeout",
+	statusInfra:     "infra-error",
+	statusCancelled: "cancelled",
+}
+
+var statusExitCodes = map[Status]int{
+	statusPassed:    exitPassed,
+	statusFailed:    exitFailed,
+	statusTimeout:   exitTimeout,
+	statusInfra:     exitInfra,
+	statusCancelled: exitAborted,
+}
+
+func (s Status) String() string {
+	return statusNames[s]
+}
+
+func (s Status) exitCode() int {
+	return statusExitCodes[s]
+}
+
+func (s Status) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Status) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+
+	for status, n := range statusNames {
+		if n == name {
+			*s = status
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unknown status %s", name)
+}
+
+// Whether a docker run failed because of docker rather than the command it
+// ran, docker exits with 125 when it fails and 126 or 127 when the command
+// can't be run
+func dockerFailed(err error) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return err != nil
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+
+	code := status.ExitStatus()
+	return code == 125 || code == 126 || code == 127
+}
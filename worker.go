@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/krisrang/cirunner/Godeps/_workspace/src/github.com/pebblescape/pebblescape/pkg/random"
+)
+
+var workerCommand = cli.Command{
+	Name:  "worker",
+	Usage: "run splits handed out by a coordinator",
+	Description: "Connects to a cirunner started with --coordinator, builds the image from the\n" +
+		"   local checkout in --path and runs up to --maxruns splits at a time with the\n" +
+		"   local docker, sending results and reports back to the coordinator.",
+	Action: worker,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "coordinator",
+			EnvVar: "CIRUNNER_COORDINATOR",
+			Usage:  "URL of the coordinator",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			EnvVar: "CIRUNNER_TOKEN",
+			Usage:  "token shared with the coordinator",
+		},
+		cli.DurationFlag{
+			Name:  "wait",
+			Value: 5 * time.Minute,
+			Usage: "how long to wait for the coordinator to come up",
+		},
+	},
+}
+
+// Client of the coordinator API
+type CoordinatorClient struct {
+	url    string
+	token  string
+	worker string
+	client *http.Client
+}
+
+var errBuildFinished = fmt.Errorf("Build finished")
+
+var errLeaseLost = fmt.Errorf("Lease lost")
+
+// How often workers without work ask the coordinator for some
+const workerPoll = 5 * time.Second
+
+func (cc *CoordinatorClient) do(method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("worker", cc.worker)
+
+	req, err := http.NewRequest(method, strings.TrimRight(cc.url, "/")+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if cc.token != "" {
+		req.Header.Set(tokenHeader, cc.token)
+	}
+
+	res, err := cc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 400 && res.StatusCode != http.StatusGone && res.StatusCode != http.StatusConflict {
+		msg, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s failed: %s %s", method, path, res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return res, nil
+}
+
+func (cc *CoordinatorClient) build() (WireBuild, error) {
+	var b WireBuild
+
+	res, err := cc.do("GET", "/build", nil, nil)
+	if err != nil {
+		return b, err
+	}
+	defer res.Body.Close()
+
+	return b, json.NewDecoder(res.Body).Decode(&b)
+}
+
+// Lease a split, returns false if there's no work right now and
+// errBuildFinished once there won't be any more
+func (cc *CoordinatorClient) lease() (Split, bool, error) {
+	res, err := cc.do("POST", "/lease", nil, nil)
+	if err != nil {
+		return Split{}, false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusGone:
+		return Split{}, false, errBuildFinished
+	case http.StatusNoContent:
+		return Split{}, false, nil
+	}
+
+	var s WireSplit
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		return Split{}, false, err
+	}
+
+	return s.split(), true, nil
+}
+
+// Renew the lease of run, returns http.StatusConflict if the lease was
+// lost and http.StatusGone if the build was aborted
+func (cc *CoordinatorClient) heartbeat(run string) (int, error) {
+	res, err := cc.do("POST", "/heartbeat", url.Values{"run": {run}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	return res.StatusCode, nil
+}
+
+// Hand run back to the coordinator to be run by someone else
+func (cc *CoordinatorClient) release(run string) error {
+	res, err := cc.do("POST", "/release", url.Values{"run": {run}}, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// Upload the reports of s, or its coverage results or artifacts with kind
+// "coverage" or "artifacts"
+func (cc *CoordinatorClient) uploadReports(s Split, kind, dir string) error {
+	var buf bytes.Buffer
+	if err := tarDir(dir, &buf); err != nil {
+		return err
+	}
+
+	res, err := cc.do("POST", "/reports", url.Values{"run": {s.run}, "kind": {kind}}, &buf)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		return errLeaseLost
+	}
+
+	return nil
+}
+
+// Upload dir of s as kind, returns false if the lease was lost and the
+// result must not be sent
+func (cc *CoordinatorClient) upload(s Split, kind, dir string) bool {
+	err := cc.uploadReports(s, kind, dir)
+	if err == errLeaseLost {
+		msg(fmt.Sprintf("Lost lease of run %v, dropping its result", s.run))
+		return false
+	}
+	if err != nil {
+		msg(fmt.Sprintf("Uploading %s of run %v failed: %v", kind, s.run, err))
+	}
+
+	return true
+}
+
+func (cc *CoordinatorClient) sendResult(r RunResult) error {
+	body, err := json.Marshal(r.wire())
+	if err != nil {
+		return err
+	}
+
+	res, err := cc.do("POST", "/result", nil, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		return errLeaseLost
+	}
+
+	return nil
+}
+
+func worker(c *cli.Context) {
+	verbose = c.GlobalBool("verbose")
+	veryverbose = c.GlobalBool("veryverbose")
+	commit = c.GlobalBool("commit")
+	output = NewOutputMux(os.Stdout, c.GlobalBool("color"), c.GlobalBool("timestamps"))
+
+	if c.String("coordinator") == "" {
+		log.Fatal("Must specify coordinator URL")
+	}
+
+	hostname, _ := os.Hostname()
+	cc := &CoordinatorClient{
+		url:    c.String("coordinator"),
+		token:  c.String("token"),
+		worker: fmt.Sprintf("%s-%s", hostname, random.Hex(2)),
+		client: &http.Client{Timeout: time.Minute},
+	}
+
+	// The coordinator only starts serving once it has split up the build
+	topic(fmt.Sprintf("Connecting to coordinator %s", cc.url))
+	deadline := time.Now().Add(c.Duration("wait"))
+	info, err := cc.build()
+	for err != nil && time.Now().Before(deadline) {
+		time.Sleep(2 * time.Second)
+		info, err = cc.build()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if info.LeaseTTL < minLeaseTTL {
+		log.Fatal(fmt.Errorf("Invalid lease TTL %v from coordinator", info.LeaseTTL))
+	}
+
+	b, err := newBuildWithID(c, info.Name, info.ID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if info.Image != "" && !b.docker.prebuilt {
+		b.image = info.Image
+		b.docker.prebuilt = true
+	}
+
+	// Workers don't run the rspec split alongside the features
+	if len(c.GlobalStringSlice("docker-host")) == 0 {
+		b.hosts[0].capacity = b.runs
+	}
+
+	// Runs have unique names across the build, but the database containers
+	// would clash with the coordinator's when both are on the same host
+	for i, h := range b.hosts {
+		h.dbcnt = b.container(fmt.Sprintf("%s-db-%d", cc.worker, i+1))
+	}
+
+	topic(fmt.Sprintf("Working on build %s of %s as %s", b.id, b.name, cc.worker))
+
+	if err := b.prepare(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Results of a different checkout would be reported as the build's
+	if info.Context != "" && !b.docker.prebuilt {
+		image, err := b.contextImage()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if image != info.Context {
+			log.Fatal(fmt.Errorf("Checkout in %s doesn't match the coordinator's, it builds %s instead of %s", b.path, image, info.Context))
+		}
+	}
+
+	if err := b.ensureImage(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := b.createCaches(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(b, cancel)
+
+	topic("Starting database")
+	if err := b.startDB(); err != nil {
+		log.Println(err)
+		os.Exit(b.cleanup(exitInfra))
+	}
+
+	if err := b.runPrepare(ctx); err != nil {
+		log.Println(err)
+		os.Exit(b.cleanup(setupFailed(ctx)))
+	}
+
+	results := &RunResults{
+		results: make([]RunResult, 0),
+	}
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	gaveUp := false
+
+	for _, h := range b.hosts {
+		topic(fmt.Sprintf("Running up to %v runs on %v", h.capacity, h))
+		wg.Add(h.capacity)
+
+		for i := 0; i < h.capacity; i++ {
+			go func(h *DockerHost) {
+				defer wg.Done()
+
+				contact := time.Now()
+
+				for ctx.Err() == nil {
+					s, ok, err := cc.lease()
+					if err == errBuildFinished {
+						return
+					}
+					if err != nil {
+						msg(err.Error())
+
+						if time.Since(contact) > c.Duration("wait") {
+							msg("Coordinator gone, giving up")
+							mu.Lock()
+							gaveUp = true
+							mu.Unlock()
+							return
+						}
+					} else {
+						contact = time.Now()
+					}
+					if !ok {
+						time.Sleep(workerPoll)
+						continue
+					}
+
+					workerRun(ctx, cc, results, b, h, s, info.LeaseTTL)
+				}
+			}(h)
+		}
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		os.Exit(b.cleanup(exitAborted))
+	}
+
+	// Without word from the coordinator the build may not have finished
+	if gaveUp {
+		os.Exit(b.cleanup(exitInfra))
+	}
+	os.Exit(b.cleanup(0))
+}
+
+// Run a leased split, keeping the lease alive and aborting the run if it's
+// lost, then send reports and result to the coordinator
+func workerRun(ctx context.Context, cc *CoordinatorClient, results *RunResults, b *Build, h *DockerHost, s Split, ttl time.Duration) {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lost := false
+	finished := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(ttl / 4)
+		defer ticker.Stop()
+
+		renewed := time.Now()
+
+		for {
+			select {
+			case <-finished:
+				return
+			case <-ticker.C:
+				status, err := cc.heartbeat(s.run)
+				if err != nil {
+					msg(fmt.Sprintf("Heartbeat of run %v failed: %v", s.run, err))
+
+					// Keep going, the coordinator may be back before the
+					// lease expires
+					if time.Since(renewed) < ttl {
+						continue
+					}
+					status = http.StatusConflict
+				}
+
+				switch status {
+				case http.StatusOK:
+					renewed = time.Now()
+				case http.StatusConflict:
+					msg(fmt.Sprintf("Lost lease of run %v, aborting", s.run))
+					lost = true
+					cancel()
+					return
+				case http.StatusGone:
+					msg(fmt.Sprintf("Build aborted, stopping run %v", s.run))
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	registerResult(results, runSplit(runCtx, b, h, s))
+	close(finished)
+	<-stopped
+
+	// The split was handed to someone else, this result doesn't count
+	r, ok := results.take(s.run)
+	if !ok || lost {
+		return
+	}
+
+	// This worker is going away, not the build, so the split is run again
+	// elsewhere rather than reported as cancelled
+	if ctx.Err() != nil {
+		if err := cc.release(s.run); err != nil {
+			msg(fmt.Sprintf("Releasing run %v failed, it's requeued once its lease expires: %v", s.run, err))
+		}
+		return
+	}
+
+	if !cc.upload(s, "reports", s.reportDir()) {
+		return
+	}
+
+	if b.config.Coverage != nil && !cc.upload(s, "coverage", b.coverageDir(s.run)) {
+		return
+	}
+
+	if len(r.artifacts) > 0 && !cc.upload(s, "artifacts", b.artifactDir(s.run)) {
+		return
+	}
+
+	if err := cc.sendResult(r); err != nil {
+		msg(fmt.Sprintf("Sending result of run %v failed: %v", s.run, err))
+	}
+}